@@ -0,0 +1,8 @@
+// Command stress load tests HTTP endpoints, see the README for its flags.
+package main
+
+import stress "github.com/SpyPower/simple-http-stress"
+
+func main() {
+	stress.Main()
+}
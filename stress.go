@@ -1,198 +1,5706 @@
-package main
+// Package stress sends HTTP requests to one or more targets at a controlled
+// rate and concurrency and summarizes how they went. The command line tool
+// lives in cmd/stress.
+package stress
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"math"
+	"math/rand"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/time/rate"
 )
 
-const (
-	totalRequests = 15
-)
+// Config holds the settings of a run. Start from DefaultConfig, which has
+// the defaults of the command line flags, and add at least one target.
+// parseFlags fills it in from the command line; the parsed forms are kept,
+// e.g. the body read from -body-file.
+type Config struct {
+	Targets       []Target
+	RoundRobin    bool
+	Sitemap       string
+	SitemapLimit  int
+	TotalRequests int
+	Concurrency   int
+	Duration      time.Duration
+	RequestRate   float64
+	// LoadProfile replaces RequestRate and Duration with steps of their own
+	LoadProfile  []LoadStep
+	Burst        int
+	PerHostRate  float64
+	RampUp       time.Duration
+	StartJitter  time.Duration
+	Warmup       int
+	PrewarmConns int
+	ThinkTimeMin time.Duration
+	ThinkTimeMax time.Duration
+
+	Method            string
+	Headers           map[string]string
+	Body              []byte
+	UserAgents        []string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+	// HMACSecret signs the body of every request, with HMACHash, into the
+	// HMACHeader. With HMACTimestampHeader the request carries its Unix time
+	// in that header and "<timestamp>.<body>" is signed instead.
+	HMACSecret          string
+	HMACHeader          string
+	HMACHash            func() hash.Hash
+	HMACTimestampHeader string
+	UseCookies          bool
+	Cookies             []*http.Cookie
+	NoCompression       bool
+	// Bodies replace Body, every request takes the next one in turn or, with
+	// RandomBodies, one at random
+	Bodies       []NamedBody
+	RandomBodies bool
+	// Chunked sends request bodies with chunked transfer encoding instead of
+	// a Content-Length, over HTTP/1.1
+	Chunked bool
+	// IfNoneMatch is sent as the If-None-Match header of every request, to
+	// get 304 responses from a cache that holds the entity tag
+	IfNoneMatch string
+	// TraceHeader is the header every request carries a UUID of its own in,
+	// the same one across its retries
+	TraceHeader string
+
+	Timeout         time.Duration
+	BodyReadTimeout time.Duration
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	RetryOn5xx      bool
+	MaxRedirects    int
+	// RetryPolicies take over from MaxRetries, RetryOn5xx and the backoff
+	// for the responses with one of their status codes
+	RetryPolicies map[int]RetryPolicy
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DisableKeepAlive    bool
+	HTTP2               bool
+	ProxyURL            *url.URL
+	TLSConfig           *tls.Config
+	LocalAddrs          []net.IP
+	// Resolve sends connections for a "host:port" to another "ip:port"
+	Resolve map[string]string
+	// UnixSocket is dialed for every connection instead of the host of the
+	// URL, which still goes in the Host header
+	UnixSocket string
+
+	ExpectStatus       StatusSpec
+	ExpectBodyContains string
+	ExpectBodyRegex    *regexp.Regexp
+	ExpectHeaders      []HeaderExpectation
+	ReadBody           bool
+	MaxErrors          int
+	MaxErrorRate       float64
+	MaxDuration        time.Duration
+	DrainTimeout       time.Duration
+	// SSE keeps every response with an expected status open for SSEDuration
+	// and counts the Server-Sent Events it streams, instead of reading its
+	// body to the end
+	SSE         bool
+	SSEDuration time.Duration
+
+	Quiet        bool
+	HistBuckets  int
+	Verbosity    int
+	Trace        bool
+	QPSReport    time.Duration
+	SelfStats    bool
+	CSVFile      string
+	JSONLFile    string
+	SaveFailures string
+	SaveLimit    int
+	// SLOBuckets are the sorted response times to report the share of
+	// requests at or under
+	SLOBuckets []time.Duration
+	// Bootstrap is how many resamples estimate the confidence intervals of
+	// the percentiles, 0 skips them
+	Bootstrap int
+
+	// Only the command line uses these
+	data                   *dataSet
+	repeat                 int
+	failIfSuccessRateBelow float64
+	failIfP99Above         time.Duration
+	outputFormat           string
+	dryRun                 bool
+	pprofAddr              string
+	reportDir              string
+	targetArg              string
+	compareHosts           bool
+	noSummaryOnEmpty       bool
+	findMaxThroughput      bool
+	color                  bool
+	concurrencyStep        int
+	kneeErrorRate          float64
+	baseline               *Results
+	regressionThreshold    float64
+}
+
+// DefaultConfig returns a Config with the defaults of the command line flags
+// and no targets
+func DefaultConfig() Config {
+	return Config{
+		SitemapLimit:    1000,
+		TotalRequests:   15,
+		Concurrency:     50,
+		RequestRate:     100,
+		Burst:           1,
+		Method:          http.MethodGet,
+		Headers:         make(map[string]string),
+		HMACHeader:      "X-Signature",
+		HMACHash:        sha256.New,
+		Timeout:         30 * time.Second,
+		MaxRetries:      2,
+		MaxRedirects:    10,
+		IdleConnTimeout: 90 * time.Second,
+		HTTP2:           true,
+		TLSConfig:       &tls.Config{},
+		ExpectStatus:    StatusSpec{{from: 200, to: 299}},
+		ReadBody:        true,
+		HistBuckets:     10,
+		SaveLimit:       100,
+		repeat:          1,
+		outputFormat:    "text",
+	}
+}
+
+var verboseLog = log.New(os.Stderr, "", log.Ltime|log.Lmicroseconds)
+
+// Runner sends the requests of a Config and keeps what they recorded. The
+// counters are shared by all workers; everything that is more than a counter
+// is recorded per worker in workerStats and merged here once the run is over.
+type Runner struct {
+	cfg     *Config
+	client  *http.Client
+	limiter *rate.Limiter
+
+	// targets are those of the Config plus the -sitemap ones, with the
+	// defaults filled in and linked to their hostLimits
+	targets     []Target
+	totalWeight int
+	// sitemapErr is why the -sitemap URLs could not be loaded, left to the
+	// caller to report since the other targets may still be tested
+	sitemapErr error
+	nextTarget atomic.Uint64
+	nextBody   atomic.Uint64
+	// hostLimits lists a hostLimit per distinct host:port of the targets,
+	// in the order the targets were given
+	hostLimits []*hostLimit
+	recorders  []recorder
+	prewarmed  int
+	// connReuseTrace counts for every connection the transport hands out,
+	// redirects included, whether it was reused from the pool or newly opened
+	connReuseTrace *httptrace.ClientTrace
+
+	requestCount        atomic.Int64
+	successCount        atomic.Int64
+	failureCount        atomic.Int64
+	transportErrorCount atomic.Int64
+	httpErrorCount      atomic.Int64
+	retriedCount        atomic.Int64
+	bodyFailureCount    atomic.Int64
+	headerFailureCount  atomic.Int64
+	abortedCount        atomic.Int64
+	redirectCount       atomic.Int64
+	consecutiveFailures atomic.Int64
+	reusedConns         atomic.Int64
+	newConns            atomic.Int64
+	// step is the -load-profile step being run
+	step atomic.Int64
+	// requestSeq numbers requests across all workers for {{seq}}
+	requestSeq atomic.Int64
+	// savedFailures counts the files written by -save-failures, across workers
+	savedFailures atomic.Int64
+	inFlight      inFlightGauge
+	interrupted   atomic.Bool
+	abortReason   atomic.Pointer[string]
+	// stopRun stops dispatching the requests of the Run in progress
+	stopRun context.CancelFunc
+	// requestsCtx is what the requests in flight are canceled through when
+	// -max-duration or -drain-timeout is up
+	requestsCtx    context.Context
+	cancelRequests context.CancelFunc
+	wg             sync.WaitGroup
 
-var (
-	targetUrl     string
-	successCount  = 0
-	failureCount  = 0
-	mu            sync.Mutex
-	wg            sync.WaitGroup
 	responseTimes []time.Duration
-	myClient      = &http.Client{Timeout: 3000 * time.Second}
-)
+	statusCodes   map[int]int
+	protocols     map[string]int
+	tlsVersions   map[string]int
+	tlsCiphers    map[string]int
+	servers       map[string]int
+	errorCounts   map[string]int
+	endpoints     []endpointStats
+	steps         []endpointStats
+	bodies        []endpointStats
+	phases        phaseTimes
+	throughput    []ThroughputWindow
+	selfStats     SelfStats
+	bodySizes     bodySizes
+	streamEvents  []int
+	eventGaps     []time.Duration
+}
+
+// NewRunner sets up the client, the rate limiters and the targets of cfg.
+// A -sitemap is fetched here, so this already sends requests. The statuses
+// to expect and the HMAC header and hash are those of DefaultConfig when cfg
+// leaves them out.
+func NewRunner(cfg *Config) (*Runner, error) {
+	defaults := DefaultConfig()
+	if cfg.ExpectStatus == nil {
+		cfg.ExpectStatus = defaults.ExpectStatus
+	}
+	if cfg.HMACSecret != "" {
+		if cfg.HMACHeader == "" {
+			cfg.HMACHeader = defaults.HMACHeader
+		}
+		if cfg.HMACHash == nil {
+			cfg.HMACHash = defaults.HMACHash
+		}
+	}
+
+	if len(cfg.LoadProfile) > 0 {
+		cfg.Duration = 0
+		for _, step := range cfg.LoadProfile {
+			cfg.Duration += step.Duration
+		}
+	}
+
+	switch {
+	case len(cfg.Targets) == 0 && cfg.Sitemap == "":
+		return nil, errors.New("No URLs to test: the Config has no targets")
+	case cfg.Concurrency <= 0:
+		return nil, fmt.Errorf("Invalid concurrency: %d (must be a positive integer)", cfg.Concurrency)
+	case cfg.Duration <= 0 && cfg.TotalRequests <= 0:
+		return nil, fmt.Errorf("Invalid number of requests: %d (must be a positive integer)", cfg.TotalRequests)
+	case cfg.Burst <= 0:
+		return nil, fmt.Errorf("Invalid burst: %d (must be a positive integer)", cfg.Burst)
+	case cfg.SSE && cfg.SSEDuration <= 0:
+		return nil, fmt.Errorf("Invalid SSE duration: %s (must be positive)", cfg.SSEDuration)
+	}
+
+	r := &Runner{
+		cfg:         cfg,
+		client:      &http.Client{Timeout: cfg.Timeout, Transport: newTransport(cfg)},
+		stopRun:     func() {},
+		statusCodes: make(map[int]int),
+		protocols:   make(map[string]int),
+		tlsVersions: make(map[string]int),
+		tlsCiphers:  make(map[string]int),
+		servers:     make(map[string]int),
+		errorCounts: make(map[string]int),
+	}
+	// The timeout of the client covers reading the body, which for an event
+	// stream only ends after -sse-duration
+	if cfg.SSE {
+		r.client.Timeout += cfg.SSEDuration
+	}
+	r.requestsCtx, r.cancelRequests = context.WithCancel(context.Background())
+	r.connReuseTrace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				r.reusedConns.Add(1)
+			} else {
+				r.newConns.Add(1)
+			}
+		},
+	}
+
+	// The limiter holds up to burst tokens and refills them at requestRate
+	// per second, so after an idle period up to burst requests may be sent
+	// back to back before the steady rate kicks in.
+	limit := rate.Inf
+	if cfg.RequestRate > 0 {
+		limit = rate.Limit(cfg.RequestRate)
+	}
+	r.limiter = rate.NewLimiter(limit, cfg.Burst)
+
+	// Once the limit is reached the redirect response itself is returned,
+	// so its status code and latency are what gets recorded
+	r.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > cfg.MaxRedirects {
+			return http.ErrUseLastResponse
+		}
+		r.redirectCount.Add(1)
+		return nil
+	}
+
+	r.targets = slices.Clone(cfg.Targets)
+	if cfg.Sitemap != "" {
+		// Without this the redirects of the sitemap would be counted in the results
+		client := *r.client
+		client.CheckRedirect = nil
+		var locations []string
+		locations, r.sitemapErr = loadSitemap(&client, cfg.Sitemap, cfg.SitemapLimit)
+		for _, location := range locations {
+			t, err := newTarget(location, 1)
+			if err != nil {
+				continue
+			}
+			r.targets = append(r.targets, t)
+		}
+		if len(r.targets) == 0 {
+			return nil, errors.New("No URLs to test: -sitemap did not list any and no -url was given")
+		}
+	}
+
+	// Targets of a -scenario step only fill in what the step leaves out
+	for i := range r.targets {
+		t := &r.targets[i]
+		// The host is only missing from targets not made by newTarget
+		if t.host == "" {
+			checked, err := newTarget(t.URL, t.Weight)
+			if err != nil {
+				return nil, err
+			}
+			t.host = checked.host
+		}
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		if t.Method == "" {
+			t.Method = cfg.Method
+		}
+		if t.Body == nil {
+			t.Body = cfg.Body
+		}
+		headers := t.Headers
+		t.Headers = make(map[string]string, len(cfg.Headers)+len(headers))
+		for key, value := range cfg.Headers {
+			t.Headers[key] = value
+		}
+		for key, value := range headers {
+			t.Headers[key] = value
+		}
+		r.totalWeight += t.Weight
+	}
+	r.newHostLimits()
+
+	// There is a single jar for the whole run, so every worker sees the
+	// cookies any other worker received; workers are not separate sessions
+	if cfg.UseCookies || len(cfg.Cookies) > 0 {
+		jar, _ := cookiejar.New(nil)
+		for _, t := range r.targets {
+			u, _ := url.Parse(t.URL)
+			jar.SetCookies(u, cfg.Cookies)
+		}
+		r.client.Jar = jar
+	}
+
+	return r, nil
+}
+
+// Target is one endpoint under test, picked for a request in proportion to
+// its Weight, where 0 counts as 1
+type Target struct {
+	URL    string
+	host   string
+	Weight int
+	limit  *hostLimit
+
+	// What is sent to the target. These come from -method, -headers, -H and
+	// -body for a -url, and from the step for a -scenario. Left empty they
+	// are taken from the Config.
+	Name    string
+	Method  string
+	Headers map[string]string
+	Body    []byte
+}
+
+// hostLimit is the budget shared by all targets on the same host:port. Its
+// limiter applies -per-host-rate on top of the global -rate and is nil
+// without it.
+type hostLimit struct {
+	addr     string
+	limiter  *rate.Limiter
+	requests atomic.Int64
+	inFlight inFlightGauge
+}
+
+// inFlightGauge counts the requests in flight and remembers the peak
+type inFlightGauge struct {
+	current atomic.Int64
+	peak    atomic.Int64
+}
+
+// start counts a request as in flight until the returned function is called
+func (g *inFlightGauge) start() func() {
+	n := g.current.Add(1)
+	for {
+		peak := g.peak.Load()
+		if n <= peak || g.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() { g.current.Add(-1) }
+}
+
+// newHostLimits creates the per host registry and links every target to
+// the entry of its host
+func (r *Runner) newHostLimits() {
+	byAddr := make(map[string]*hostLimit)
+	for i := range r.targets {
+		u, _ := url.Parse(r.targets[i].URL)
+		limit, ok := byAddr[u.Host]
+		if !ok {
+			limit = &hostLimit{addr: u.Host}
+			if r.cfg.PerHostRate > 0 {
+				limit.limiter = rate.NewLimiter(rate.Limit(r.cfg.PerHostRate), r.cfg.Burst)
+			}
+			byAddr[u.Host] = limit
+			r.hostLimits = append(r.hostLimits, limit)
+		}
+		r.targets[i].limit = limit
+	}
+}
+
+// start counts a request to the host as in flight until the returned
+// function is called
+func (h *hostLimit) start() func() {
+	h.requests.Add(1)
+	return h.inFlight.start()
+}
+
+// parseTarget parses a -url value, a URL optionally followed by a space and
+// a weight, e.g. "http://host/a 3". A URL cannot hold a space, so nothing in
+// it is ever taken for the weight.
+func parseTarget(value string) (Target, error) {
+	rawURL, weight, weighted := strings.Cut(strings.TrimSpace(value), " ")
+	if !weighted {
+		return newTarget(rawURL, 1)
+	}
+
+	w, err := strconv.Atoi(strings.TrimSpace(weight))
+	if err != nil || w <= 0 {
+		return Target{}, fmt.Errorf("Invalid weight for %s: %q (must be a positive integer)", rawURL, strings.TrimSpace(weight))
+	}
+	return newTarget(rawURL, w)
+}
+
+// newTarget checks that rawURL is absolute and makes a target of it
+func newTarget(rawURL string, weight int) (Target, error) {
+	parsedUrl, err := url.Parse(rawURL)
+	if err != nil || parsedUrl.Scheme == "" || parsedUrl.Host == "" {
+		return Target{}, fmt.Errorf("Invalid URL: %s", rawURL)
+	}
+
+	return Target{URL: rawURL, host: parsedUrl.Hostname(), Weight: weight}, nil
+}
+
+// pickTarget returns the index of a random target, weighted by target.weight,
+// or of the next target in turn with -urls-file
+func (r *Runner) pickTarget() int {
+	if len(r.targets) == 1 {
+		return 0
+	}
+	if r.cfg.RoundRobin {
+		return int((r.nextTarget.Add(1) - 1) % uint64(len(r.targets)))
+	}
+
+	n := rand.Intn(r.totalWeight)
+	for i, t := range r.targets {
+		if n < t.Weight {
+			return i
+		}
+		n -= t.Weight
+	}
+	return len(r.targets) - 1
+}
+
+// pickAllowedTarget picks a target like pickTarget whose host is within
+// -per-host-rate. When the host of the pick is at its rate, the request goes
+// to the next target whose host is not, so that one host does not hold up
+// the workers; when every host is at its rate it waits for the one that is
+// back within it first. It reports false when the run is over before that.
+func (r *Runner) pickAllowedTarget(ctx context.Context, stats *workerStats) (int, bool) {
+	picked := r.pickTarget()
+	limiter := r.targets[picked].limit.limiter
+	if limiter == nil || limiter.Allow() {
+		return picked, true
+	}
+	for i := 1; i < len(r.targets); i++ {
+		next := (picked + i) % len(r.targets)
+		if l := r.targets[next].limit.limiter; l == nil || l.Allow() {
+			return next, true
+		}
+	}
+	if len(r.targets) == 1 {
+		return picked, waitLimiter(ctx, limiter, stats)
+	}
+
+	best, reservation := picked, limiter.Reserve()
+	for i := 1; i < len(r.targets); i++ {
+		next := (picked + i) % len(r.targets)
+		if other := r.targets[next].limit.limiter.Reserve(); other.Delay() < reservation.Delay() {
+			reservation.Cancel()
+			best, reservation = next, other
+		} else {
+			other.Cancel()
+		}
+	}
+	// Only a -burst of 0 cannot be reserved, the limiter reports why
+	if !reservation.OK() {
+		return best, waitLimiter(ctx, r.targets[best].limit.limiter, stats)
+	}
+	timer := time.NewTimer(reservation.Delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return best, true
+	case <-ctx.Done():
+		reservation.Cancel()
+		return best, false
+	}
+}
+
+// phaseTrace records how long the connection phases of a single attempt took.
+// The hooks may run on the transport's dialing goroutine, hence the mutex.
+type phaseTrace struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	// start is when the attempt was sent, ttfb runs from there to the first
+	// byte of the last response, after any redirects
+	start time.Time
+	ttfb  time.Duration
+}
+
+func (p *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			p.mu.Lock()
+			p.dnsStart = time.Now()
+			p.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			p.mu.Lock()
+			p.dns = time.Since(p.dnsStart)
+			p.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			p.mu.Lock()
+			p.connectStart = time.Now()
+			p.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			p.mu.Lock()
+			if err == nil {
+				p.connect = time.Since(p.connectStart)
+			}
+			p.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			p.mu.Lock()
+			p.tlsStart = time.Now()
+			p.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			p.mu.Lock()
+			if err == nil {
+				p.tls = time.Since(p.tlsStart)
+			}
+			p.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			p.mu.Lock()
+			p.ttfb = time.Since(p.start)
+			p.mu.Unlock()
+		},
+	}
+}
+
+// phaseTimes collects the phase durations of every traced attempt. A phase
+// is only recorded when it happened, so a reused connection adds nothing.
+type phaseTimes struct {
+	dns     []time.Duration
+	connect []time.Duration
+	tls     []time.Duration
+	ttfb    []time.Duration
+}
+
+func (p *phaseTimes) add(trace *phaseTrace) {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+
+	if trace.dns > 0 {
+		p.dns = append(p.dns, trace.dns)
+	}
+	if trace.connect > 0 {
+		p.connect = append(p.connect, trace.connect)
+	}
+	if trace.tls > 0 {
+		p.tls = append(p.tls, trace.tls)
+	}
+	if trace.ttfb > 0 {
+		p.ttfb = append(p.ttfb, trace.ttfb)
+	}
+}
+
+func (p *phaseTimes) merge(other phaseTimes) {
+	p.dns = append(p.dns, other.dns...)
+	p.connect = append(p.connect, other.connect...)
+	p.tls = append(p.tls, other.tls...)
+	p.ttfb = append(p.ttfb, other.ttfb...)
+}
+
+// workerStats holds what a single worker records, so workers never contend
+// on a shared slice or map while the run is in progress
+type workerStats struct {
+	statusCodes map[int]int
+	errors      map[string]int
+	protocols   map[string]int
+	tlsVersions map[string]int
+	tlsCiphers  map[string]int
+	servers     map[string]int
+	endpoints   []endpointStats
+	steps       []endpointStats
+	bodies      []endpointStats
+	phases      phaseTimes
+	bodySizes   bodySizes
+	// streamEvents is how many events every -sse stream delivered, eventGaps
+	// the times between two events of the same stream
+	streamEvents []int
+	eventGaps    []time.Duration
+}
+
+// bodySizes adds up the response bodies that were read to the end, as they
+// came off the connection and after decompression
+type bodySizes struct {
+	responses int
+	wire      int64
+	decoded   int64
+}
+
+// endpointStats is what was recorded for a single target, or for a step of
+// -load-profile
+type endpointStats struct {
+	success       int
+	failure       int
+	responseTimes []time.Duration
+}
+
+func (e *endpointStats) add(elapsed time.Duration, failed bool) {
+	e.responseTimes = append(e.responseTimes, elapsed)
+	if failed {
+		e.failure++
+	} else {
+		e.success++
+	}
+}
+
+func (e *endpointStats) merge(other endpointStats) {
+	e.success += other.success
+	e.failure += other.failure
+	e.responseTimes = append(e.responseTimes, other.responseTimes...)
+}
 
-var limiter = rate.NewLimiter(rate.Every(time.Second/100), 1)
+func (r *Runner) newWorkerStats() *workerStats {
+	return &workerStats{
+		statusCodes: make(map[int]int),
+		errors:      make(map[string]int),
+		protocols:   make(map[string]int),
+		tlsVersions: make(map[string]int),
+		tlsCiphers:  make(map[string]int),
+		servers:     make(map[string]int),
+		endpoints:   make([]endpointStats, len(r.targets)),
+		steps:       make([]endpointStats, len(r.cfg.LoadProfile)),
+		bodies:      make([]endpointStats, len(r.cfg.Bodies)),
+	}
+}
+
+// mergeWorkerStats folds the per worker results into the totals of the run
+func (r *Runner) mergeWorkerStats(all []*workerStats) {
+	r.endpoints = make([]endpointStats, len(r.targets))
+	r.steps = make([]endpointStats, len(r.cfg.LoadProfile))
+	r.bodies = make([]endpointStats, len(r.cfg.Bodies))
+	for _, stats := range all {
+		for code, count := range stats.statusCodes {
+			r.statusCodes[code] += count
+		}
+		for proto, count := range stats.protocols {
+			r.protocols[proto] += count
+		}
+		for version, count := range stats.tlsVersions {
+			r.tlsVersions[version] += count
+		}
+		for cipher, count := range stats.tlsCiphers {
+			r.tlsCiphers[cipher] += count
+		}
+		for server, count := range stats.servers {
+			r.servers[server] += count
+		}
+		for category, count := range stats.errors {
+			r.errorCounts[category] += count
+		}
+		r.phases.merge(stats.phases)
+		r.bodySizes.responses += stats.bodySizes.responses
+		r.bodySizes.wire += stats.bodySizes.wire
+		r.bodySizes.decoded += stats.bodySizes.decoded
+		r.streamEvents = append(r.streamEvents, stats.streamEvents...)
+		r.eventGaps = append(r.eventGaps, stats.eventGaps...)
+		for i, endpoint := range stats.endpoints {
+			r.endpoints[i].merge(endpoint)
+			r.responseTimes = append(r.responseTimes, endpoint.responseTimes...)
+		}
+		for i, step := range stats.steps {
+			r.steps[i].merge(step)
+		}
+		for i, body := range stats.bodies {
+			r.bodies[i].merge(body)
+		}
+	}
+}
 
-func fetch() {
-	if err := limiter.Wait(context.Background()); err != nil {
-		fmt.Println("Error waiting for rate limiter:", err)
+func (r *Runner) fetch(ctx context.Context, stats *workerStats) {
+	if !waitLimiter(ctx, r.limiter, stats) {
+		return
+	}
+	targetIndex, ok := r.pickAllowedTarget(ctx, stats)
+	if !ok {
 		return
 	}
+	t := r.targets[targetIndex]
+	endpoint := &stats.endpoints[targetIndex]
 
-	defer wg.Done()
+	index := r.requestCount.Add(1)
+	step := int(r.step.Load())
+	defer r.inFlight.start()()
+	defer t.limit.start()()
 
 	var resp *http.Response
 	var err error
 	var elapsed time.Duration
+	attempts := 0
+	// Canceling the context of the requests aborts the read of a body that
+	// is still going once -body-read-timeout is up
+	requestCtx, stopBody := context.WithCancel(r.requestsCtx)
+	defer stopBody()
+
+	prepared := r.prepareRequest(t)
+	requestUrl := prepared.url
+	if prepared.traceID != "" && r.cfg.Verbosity > 0 {
+		verboseLog.Printf("Request %d has %s %s", index, r.cfg.TraceHeader, prepared.traceID)
+	}
+
+	if len(r.recorders) > 0 {
+		requestStart := time.Now()
+		defer func() {
+			record := requestRecord{index: index, start: requestStart, url: requestUrl, method: prepared.method, latency: elapsed, attempts: attempts, err: err}
+			if resp != nil {
+				record.status = resp.StatusCode
+			}
+			for _, rec := range r.recorders {
+				rec.record(record)
+			}
+		}()
+	}
+
+	// abandoned is set when the run ends while waiting to retry
+	abandoned := false
+attempts:
+	for attempt := 0; ; attempt++ {
+		attempts++
 
-	for attempts := 0; attempts < 3; attempts++ {
 		start := time.Now()
 		var req *http.Request
-		req, err = http.NewRequest("GET", targetUrl, nil)
+		req, err = prepared.build(r.cfg)
 		if err != nil {
-			fmt.Println(err)
+			// It never got a response, so it fails as a transport error,
+			// but without a response time since nothing was sent
+			resp = nil
+			stats.errors["invalid request: "+err.Error()]++
+			r.transportErrorCount.Add(1)
+			r.failureCount.Add(1)
+			endpoint.failure++
+			r.checkCircuitBreaker(true)
 			return
 		}
-		// Check if the URL contains "/api" and add headers and data
-		if strings.Contains(targetUrl, "/api") {
-			// Load headers from a JSON file
-			headers, err := loadHeaders("headers.json")
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			for key, value := range headers {
-				req.Header.Add(key, value)
-			}
 
-			// Add the data payload
-			req.Method = "POST"
-			req.Header.Set("Content-Type", "application/json")
-			req.Body = io.NopCloser(strings.NewReader(`{"action":"get_stats"}`))
+		req = req.WithContext(httptrace.WithClientTrace(requestCtx, r.connReuseTrace))
+		var trace *phaseTrace
+		if r.cfg.Trace {
+			trace = &phaseTrace{start: start}
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
 		}
 
-		resp, err = myClient.Do(req)
+		resp, err = r.client.Do(req)
 		elapsed = time.Since(start)
 
+		if trace != nil {
+			stats.phases.add(trace)
+		}
+
+		if r.cfg.Verbosity > 0 {
+			r.logAttempt(req, resp, err, elapsed, attempts)
+		}
+
 		if err != nil {
-			fmt.Println(err)
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// If it's a timeout error, retry the request
-				continue
-			} else {
-				// If it's another kind of error, don't retry
-				return
-			}
-		} else {
-			// If there's no error, break the loop
+			stats.errors[categorizeError(err)]++
+		}
+
+		if !r.shouldRetry(resp, err, attempt) {
 			break
 		}
+		delay := r.retryDelay(resp, attempt)
+
+		// Release the connection of a response that is going to be retried
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		// The end of the run, -max-duration and -drain-timeout cut the wait
+		// short and abort the request
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				resp, err = nil, ctx.Err()
+				abandoned = true
+				break attempts
+			case <-r.requestsCtx.Done():
+				resp, err = nil, r.requestsCtx.Err()
+				abandoned = true
+				break attempts
+			}
+		}
 	}
 
+	bodyValid := true
+	headersValid := true
+	bodyFailed := false
 	if resp != nil {
 		defer resp.Body.Close()
 
-		if resp.StatusCode == 400 {
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				fmt.Println("Error reading response body:", err)
-				return
+		if len(r.cfg.ExpectHeaders) > 0 {
+			if failure := r.checkHeaders(resp.Header); failure != "" {
+				headersValid = false
+				stats.errors[failure]++
+			}
+		}
+
+		// Headers arrived in time, the body gets -body-read-timeout on top
+		var timerFired atomic.Bool
+		if r.cfg.BodyReadTimeout > 0 && !r.cfg.SSE {
+			timer := time.AfterFunc(r.cfg.BodyReadTimeout, func() {
+				timerFired.Store(true)
+				stopBody()
+			})
+			defer timer.Stop()
+		}
+		var bodyErr error
+
+		body := &responseBody{wire: resp.Body, encoding: resp.Header.Get("Content-Encoding")}
+		checkBody := r.cfg.ExpectBodyContains != "" || r.cfg.ExpectBodyRegex != nil
+		// The body of a failed request is only needed when it is going to be saved
+		saveBody := r.cfg.SaveFailures != "" && !r.cfg.ExpectStatus.matches(resp.StatusCode)
+		if r.cfg.SSE && r.cfg.ExpectStatus.matches(resp.StatusCode) {
+			// A stream is cut off when -sse-duration is up, that is how it
+			// is meant to end rather than a failure
+			var streamOver atomic.Bool
+			timer := time.AfterFunc(r.cfg.SSEDuration, func() {
+				streamOver.Store(true)
+				stopBody()
+			})
+			defer timer.Stop()
+			events, streamErr := readEvents(body, stats)
+			stats.streamEvents = append(stats.streamEvents, events)
+			if streamErr != nil && !streamOver.Load() && r.requestsCtx.Err() == nil {
+				bodyErr = streamErr
+			}
+		} else if resp.StatusCode == 400 || checkBody || saveBody {
+			var bodyBytes []byte
+			bodyBytes, bodyErr = io.ReadAll(body)
+			if bodyErr == nil {
+				if resp.StatusCode == 400 && r.cfg.Verbosity > 0 {
+					verboseLog.Printf("Response body: %s", bodyBytes)
+				}
+				if checkBody {
+					bodyValid = r.validateBody(bodyBytes)
+				}
+				stats.bodySizes.add(body)
+				if r.cfg.SaveFailures != "" && (!bodyValid || !r.cfg.ExpectStatus.matches(resp.StatusCode)) {
+					if err := r.saveFailure(index, prepared, resp, bodyBytes); err != nil {
+						stats.errors["saving failure: "+err.Error()]++
+					}
+				}
+			}
+		} else if r.cfg.ReadBody {
+			// The transport only reuses a connection whose body was read to
+			// the end. A body that is only drained fails the request just
+			// when -body-read-timeout or -max-duration cut it off.
+			if _, bodyErr = io.Copy(io.Discard, body); bodyErr == nil {
+				stats.bodySizes.add(body)
+			} else if !timerFired.Load() && r.requestsCtx.Err() == nil {
+				bodyErr = nil
+			}
+		}
+
+		if bodyErr != nil {
+			if timerFired.Load() {
+				bodyErr = errBodyReadTimeout
 			}
-			fmt.Println("Response body:", string(bodyBytes))
+			bodyFailed = true
+			err = bodyErr
+			stats.errors["reading body: "+categorizeError(bodyErr)]++
+		}
+	}
+
+	if attempts > 1 {
+		r.retriedCount.Add(1)
+	}
+	if resp != nil {
+		stats.statusCodes[resp.StatusCode]++
+		stats.protocols[resp.Proto]++
+		// resp.TLS is nil for plain HTTP targets
+		if resp.TLS != nil {
+			stats.tlsVersions[tls.VersionName(resp.TLS.Version)]++
+			stats.tlsCiphers[tls.CipherSuiteName(resp.TLS.CipherSuite)]++
+		}
+		if server := resp.Header.Get("Server"); server != "" {
+			stats.servers[server]++
 		}
 	}
+	// Canceled by -max-duration or -drain-timeout before it completed, or
+	// left waiting to retry when the run ended, it neither failed nor succeeded
+	if abandoned || (resp == nil || bodyFailed) && r.requestsCtx.Err() != nil {
+		r.abortedCount.Add(1)
+		return
+	}
 
-	mu.Lock()
-	responseTimes = append(responseTimes, elapsed)
-	if resp != nil && resp.StatusCode == 200 {
-		successCount++
+	failed := true
+	switch {
+	case resp == nil || bodyFailed:
+		r.transportErrorCount.Add(1)
+	case !r.cfg.ExpectStatus.matches(resp.StatusCode):
+		r.httpErrorCount.Add(1)
+	case !headersValid:
+		r.headerFailureCount.Add(1)
+	case !bodyValid:
+		r.bodyFailureCount.Add(1)
+	default:
+		failed = false
+	}
+	if failed {
+		r.failureCount.Add(1)
 	} else {
-		failureCount++
+		r.successCount.Add(1)
+	}
+	endpoint.add(elapsed, failed)
+	// With -load-profile a request counts for the step it was sent in
+	if len(r.cfg.LoadProfile) > 0 {
+		stats.steps[step].add(elapsed, failed)
 	}
-	mu.Unlock()
+	if prepared.bodyIndex >= 0 {
+		stats.bodies[prepared.bodyIndex].add(elapsed, failed)
+	}
+	r.checkCircuitBreaker(failed)
 }
 
-func loadHeaders(filename string) (map[string]string, error) {
-	var headers map[string]string
+// readEvents counts the Server-Sent Events of a stream until it ends or is
+// cut off, and records the time between two of them in stats. As with
+// EventSource, only the blank line after a block with a data field
+// dispatches an event; comments and blocks without data do not count.
+func readEvents(body io.Reader, stats *workerStats) (int, error) {
+	reader := bufio.NewReader(body)
+	events := 0
+	hasData := false
+	var last time.Time
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A block the stream ended in the middle of is not dispatched
+			if err == io.EOF {
+				err = nil
+			}
+			return events, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if hasData {
+				now := time.Now()
+				if events > 0 {
+					stats.eventGaps = append(stats.eventGaps, now.Sub(last))
+				}
+				last = now
+				events++
+				hasData = false
+			}
+		case line == "data" || strings.HasPrefix(line, "data:"):
+			hasData = true
+		}
+	}
+}
 
-	bytes, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
+// errBodyReadTimeout is recorded for a request whose body took longer than
+// -body-read-timeout to read
+var errBodyReadTimeout = errors.New("body read timeout")
+
+// errorRateMinRequests is how many requests have to complete before
+// -max-error-rate is checked, so that the first failure does not end the run
+const errorRateMinRequests = 20
+
+// checkCircuitBreaker ends the run through stopRun once -max-errors failures
+// in a row or a failure rate above -max-error-rate have been seen
+func (r *Runner) checkCircuitBreaker(failed bool) {
+	if r.abortReason.Load() != nil {
+		return
 	}
 
-	err = json.Unmarshal(bytes, &headers)
-	if err != nil {
-		return nil, err
+	if !failed {
+		r.consecutiveFailures.Store(0)
+	} else if n := r.consecutiveFailures.Add(1); r.cfg.MaxErrors > 0 && n >= int64(r.cfg.MaxErrors) {
+		r.abortRun(fmt.Sprintf("%d failures in a row (-max-errors)", n))
+		return
 	}
 
-	return headers, nil
+	if r.cfg.MaxErrorRate > 0 {
+		failed := r.failureCount.Load()
+		completed := r.successCount.Load() + failed
+		if completed >= errorRateMinRequests {
+			if errorRate := float64(failed) / float64(completed) * 100; errorRate > r.cfg.MaxErrorRate {
+				r.abortRun(fmt.Sprintf("error rate %.2f%% above %.2f%% (-max-error-rate)", errorRate, r.cfg.MaxErrorRate))
+			}
+		}
+	}
 }
 
-func calculatePercentile(durations []time.Duration, percentile float64) time.Duration {
-	if len(durations) == 0 {
-		return 0
+// abortRun stops sending new requests, the ones in flight still complete
+func (r *Runner) abortRun(reason string) {
+	if r.abortReason.CompareAndSwap(nil, &reason) {
+		r.stopRun()
 	}
+}
 
-	sort.Slice(durations, func(i, j int) bool {
-		return durations[i] < durations[j]
-	})
-
-	index := int(math.Ceil(percentile/100.0*float64(len(durations)))) - 1
-	return durations[index]
+// responseBody decompresses a gzip or deflate encoded response body while
+// counting the bytes read off the connection and the bytes decoded from them.
+// The transport is told not to decompress on its own, it would hide the size
+// on the wire. The decoder is only set up on the first read, so an empty body,
+// as for HEAD or 304, is not a gzip error.
+type responseBody struct {
+	wire     io.Reader
+	encoding string
+	decoder  io.Reader
+	read     int64
+	decoded  int64
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run stress.go <url>")
-		os.Exit(1)
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.decoder == nil {
+		wire := countingReader{reader: b.wire, count: &b.read}
+		switch strings.ToLower(b.encoding) {
+		case "gzip", "x-gzip":
+			decoder, err := gzip.NewReader(wire)
+			if err != nil {
+				return 0, err
+			}
+			b.decoder = decoder
+		case "deflate":
+			decoder, err := zlib.NewReader(wire)
+			if err != nil {
+				return 0, err
+			}
+			b.decoder = decoder
+		default:
+			b.decoder = wire
+		}
 	}
 
-	targetUrl = os.Args[1]
+	n, err := b.decoder.Read(p)
+	b.decoded += int64(n)
+	return n, err
+}
 
-	start := time.Now()
+// countingReader adds the number of bytes read through it to count
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
 
-	wg.Add(totalRequests)
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	*r.count += int64(n)
+	return n, err
+}
 
-	for i := 0; i < totalRequests; i++ {
-		go fetch()
-	}
-	wg.Wait()
+func (s *bodySizes) add(body *responseBody) {
+	s.responses++
+	s.wire += body.read
+	s.decoded += body.decoded
+}
 
-	totalElapsed := time.Since(start)
+// preparedRequest is what stays the same across the attempts of a request.
+// Placeholders are filled in once per request, so retries resend exactly the
+// same URL, headers and body.
+type preparedRequest struct {
+	method    string
+	url       string
+	headers   map[string]string
+	userAgent string
+	traceID   string
+	body      []byte
+	// bodyIndex is the body of -body-dir that was picked, -1 without one
+	bodyIndex int
+}
 
-	var totalResponseTime time.Duration
-	for _, t := range responseTimes {
-		totalResponseTime += t
+func (r *Runner) prepareRequest(t Target) preparedRequest {
+	values := r.newTemplateValues()
+	p := preparedRequest{
+		method:    t.Method,
+		url:       expandPlaceholders(t.URL, values),
+		headers:   expandHeaders(t.Headers, values),
+		userAgent: r.pickUserAgent(),
+		body:      t.Body,
+		bodyIndex: -1,
 	}
+	if len(r.cfg.Bodies) > 0 {
+		p.bodyIndex = r.pickBody()
+		p.body = r.cfg.Bodies[p.bodyIndex].Data
+	}
+	if r.cfg.TraceHeader != "" {
+		p.traceID = newUUID()
+	}
+	if bytes.Contains(p.body, []byte("{{")) {
+		p.body = []byte(expandPlaceholders(string(p.body), values))
+	}
+	return p
+}
+
+// build creates the http.Request of a single attempt, with the authentication
+// and compression settings of cfg
+func (p preparedRequest) build(cfg *Config) (*http.Request, error) {
+	req, err := http.NewRequest(p.method, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range p.headers {
+		req.Header.Set(key, value)
+	}
+	if p.userAgent != "" {
+		req.Header.Set("User-Agent", p.userAgent)
+	}
+	if p.traceID != "" {
+		req.Header.Set(cfg.TraceHeader, p.traceID)
+	}
+	if cfg.IfNoneMatch != "" && req.Header.Get("If-None-Match") == "" {
+		req.Header.Set("If-None-Match", cfg.IfNoneMatch)
+	}
+	if cfg.SSE && req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	if !cfg.NoCompression && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	if cfg.BasicAuthUser != "" {
+		req.SetBasicAuth(cfg.BasicAuthUser, cfg.BasicAuthPassword)
+	}
+	if cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+	// The body has its placeholders filled in by now, so the signature
+	// matches what is sent
+	if cfg.HMACSecret != "" {
+		message := p.body
+		if cfg.HMACTimestampHeader != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(cfg.HMACTimestampHeader, timestamp)
+			message = append([]byte(timestamp+"."), p.body...)
+		}
+		req.Header.Set(cfg.HMACHeader, signHMAC(cfg.HMACHash, cfg.HMACSecret, message))
+	}
+
+	// A fresh reader is needed on every attempt, the previous one has
+	// already been consumed by the transport
+	if body := p.body; len(body) > 0 && methodAllowsBody(p.method) {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+		if cfg.Chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+	} else if methodExpectsBody(p.method) {
+		// Sent as "Content-Length: 0", so the server does not wait for a body
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+	}
+
+	return req, nil
+}
+
+// printDryRun shows the request that would be sent to every target, without
+// sending anything
+func (r *Runner) printDryRun() {
+	fmt.Println("Dry run, no requests were sent")
+	for _, t := range r.targets {
+		p := r.prepareRequest(t)
+		req, err := p.build(r.cfg)
+		if err != nil {
+			fmt.Println("Invalid request:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println()
+		fmt.Printf("%s %s\n", req.Method, req.URL.Redacted())
+		keys := make([]string, 0, len(req.Header))
+		for key := range req.Header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := strings.Join(req.Header[key], ", ")
+			if slices.Contains(redactedHeaders, key) {
+				value = "[redacted]"
+			}
+			fmt.Printf("%s: %s\n", key, value)
+		}
+		if req.Body != nil {
+			fmt.Printf("\n%s\n", p.body)
+		}
+	}
+}
+
+// waitLimiter blocks until l lets the next request through. It reports false
+// when the request should not be sent because the run is over.
+func waitLimiter(ctx context.Context, l *rate.Limiter, stats *workerStats) bool {
+	err := l.Wait(ctx)
+	if err == nil {
+		return true
+	}
+	// The run ends before the limiter would let this request through
+	if _, ok := ctx.Deadline(); ok || ctx.Err() != nil {
+		<-ctx.Done()
+		return false
+	}
+	stats.errors["rate limiter: "+err.Error()]++
+	return false
+}
+
+// saveFailure writes the status line, headers and body of a failed request
+// to a file in -save-failures, until -save-limit files have been written.
+// The name starts with the time, so the files sort in the order of the run.
+func (r *Runner) saveFailure(index int64, prepared preparedRequest, resp *http.Response, body []byte) error {
+	if r.savedFailures.Add(1) > int64(r.cfg.SaveLimit) {
+		return nil
+	}
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "%s %s\n\n", prepared.method, redactURL(prepared.url))
+	fmt.Fprintf(&content, "%s %s\n", resp.Proto, resp.Status)
+	resp.Header.Write(&content)
+	content.WriteString("\n")
+	content.Write(body)
+
+	name := fmt.Sprintf("%s-%06d.txt", time.Now().Format("20060102T150405.000"), index)
+	return os.WriteFile(filepath.Join(r.cfg.SaveFailures, name), content.Bytes(), 0o644)
+}
+
+// redactURL hides the password of a URL with credentials in it
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// signHMAC returns the hex encoded HMAC of message
+func signHMAC(newHash func() hash.Hash, secret string, message []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hmacHashes are the algorithms -hmac-algo accepts
+var hmacHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HeaderExpectation is a header every response must have, with exactly
+// Value unless Value is empty
+type HeaderExpectation struct {
+	Name  string
+	Value string
+}
+
+// parseHeaderExpectation parses "Name: value", or just "Name" for a header
+// that only has to be present
+func parseHeaderExpectation(spec string) (HeaderExpectation, error) {
+	name, value, _ := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return HeaderExpectation{}, fmt.Errorf("%q must be in the form \"Name: value\" or \"Name\"", spec)
+	}
+	return HeaderExpectation{Name: name, Value: strings.TrimSpace(value)}, nil
+}
+
+// checkHeaders returns why a response does not have the headers of
+// -expect-header, or "" when it has all of them
+func (r *Runner) checkHeaders(header http.Header) string {
+	for _, expected := range r.cfg.ExpectHeaders {
+		values, ok := header[http.CanonicalHeaderKey(expected.Name)]
+		switch {
+		case !ok:
+			return "header " + expected.Name + " missing"
+		case expected.Value != "" && !slices.Contains(values, expected.Value):
+			return "header " + expected.Name + " mismatch"
+		}
+	}
+	return ""
+}
+
+// validateBody checks a response body against -expect-body-contains and
+// -expect-body-regex
+func (r *Runner) validateBody(body []byte) bool {
+	if r.cfg.ExpectBodyContains != "" && !bytes.Contains(body, []byte(r.cfg.ExpectBodyContains)) {
+		return false
+	}
+	if r.cfg.ExpectBodyRegex != nil && !r.cfg.ExpectBodyRegex.Match(body) {
+		return false
+	}
+	return true
+}
+
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// headerFlag collects repeated -H "Key: Value" flags
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("header must be in the form \"Key: Value\", got %q", value)
+	}
+	h[key] = strings.TrimSpace(val)
+	return nil
+}
+
+type statusRange struct {
+	from, to int
+}
+
+// StatusSpec is the set of status codes counted as a success
+type StatusSpec []statusRange
+
+func (s StatusSpec) matches(code int) bool {
+	for _, r := range s {
+		if code >= r.from && code <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the spec the way ParseStatusSpec reads it
+func (s StatusSpec) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = strconv.Itoa(r.from)
+		if r.to != r.from {
+			parts[i] += "-" + strconv.Itoa(r.to)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseStatusSpec parses a single code ("200"), a comma list ("200,201,204"),
+// a range ("200-299") or any combination of those
+func ParseStatusSpec(spec string) (StatusSpec, error) {
+	var result StatusSpec
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+
+		start, err := parseStatusCode(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseStatusCode(to)
+		if err != nil {
+			return nil, err
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+
+		result = append(result, statusRange{from: start, to: end})
+	}
+
+	return result, nil
+}
+
+func parseStatusCode(value string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("invalid status code %q", value)
+	}
+	return code, nil
+}
+
+// redactedHeaders are never written to the verbose log
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// logAttempt writes one line per attempt to the verbose log, and with -vv
+// the request and response headers as well
+func (r *Runner) logAttempt(req *http.Request, resp *http.Response, err error, elapsed time.Duration, attempt int) {
+	status := "error: " + fmt.Sprint(err)
+	if err == nil {
+		status = resp.Status
+	}
+	verboseLog.Printf("%s %s -> %s in %s (attempt %d)", req.Method, req.URL.Redacted(), status, elapsed, attempt)
+
+	if r.cfg.Verbosity < 2 {
+		return
+	}
+	logHeaders("> ", req.Header)
+	if resp != nil {
+		logHeaders("< ", resp.Header)
+	}
+}
+
+func logHeaders(prefix string, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := strings.Join(header[key], ", ")
+		if slices.Contains(redactedHeaders, key) {
+			value = "[redacted]"
+		}
+		verboseLog.Printf("%s%s: %s", prefix, key, value)
+	}
+}
+
+// categorizeError maps an error to a short category such as "timeout" or
+// "connection refused", so the summary can group similar failures
+func categorizeError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var urlErr *url.Error
+
+	switch {
+	case errors.Is(err, errBodyReadTimeout):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "EOF"
+	case errors.As(err, &urlErr):
+		// Drop the method and URL, they are the same for every request
+		return urlErr.Err.Error()
+	default:
+		return err.Error()
+	}
+}
+
+// shouldRetry reports whether an attempt that ended with resp and err, after
+// retries retries, is worth sending again. Timeouts, refused and reset
+// connections are retried up to -retries times, and so are 5xx responses with
+// -retry-on-5xx. A status of -retry-policy is retried as its policy says.
+func (r *Runner) shouldRetry(resp *http.Response, err error, retries int) bool {
+	if err != nil {
+		if retries >= r.cfg.MaxRetries {
+			return false
+		}
+		// Client.Timeout expiring surfaces as a *url.Error wrapping
+		// context.DeadlineExceeded, which also reports Timeout()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+	}
+
+	if policy, ok := r.cfg.RetryPolicies[resp.StatusCode]; ok {
+		return retries < policy.MaxRetries
+	}
+	return retries < r.cfg.MaxRetries && r.cfg.RetryOn5xx && resp.StatusCode >= 500 && resp.StatusCode <= 599
+}
+
+// retryDelay is how long to wait before retrying a request that has been
+// retried retries times so far. The backoff doubles with every retry, except
+// under a fixed -retry-policy, and a 429 or 503 of a -retry-policy status
+// waits for as long as its Retry-After asks instead, up to -timeout if set.
+func (r *Runner) retryDelay(resp *http.Response, retries int) time.Duration {
+	if resp == nil {
+		return r.cfg.RetryBackoff * time.Duration(1<<retries)
+	}
+	policy, ok := r.cfg.RetryPolicies[resp.StatusCode]
+	if !ok {
+		return r.cfg.RetryBackoff * time.Duration(1<<retries)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			// A -timeout of 0 means none, not a wait of 0
+			if r.cfg.Timeout > 0 {
+				delay = min(delay, r.cfg.Timeout)
+			}
+			return delay
+		}
+	}
+	if policy.Fixed {
+		return r.cfg.RetryBackoff
+	}
+	return r.cfg.RetryBackoff * time.Duration(1<<retries)
+}
+
+// parseRetryAfter reads a Retry-After header, either seconds or an HTTP date,
+// into how long to wait from now. A date in the past means no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
+
+// RetryPolicy is how the responses with one status code are retried: up to
+// MaxRetries times, with a backoff that doubles every retry or, when Fixed,
+// stays at -retry-backoff
+type RetryPolicy struct {
+	MaxRetries int
+	Fixed      bool
+}
+
+// parseRetryPolicies parses a comma separated list of
+// "status:retries[:exponential|fixed]", e.g. "429:3:exponential,404:0"
+func parseRetryPolicies(spec string) (map[int]RetryPolicy, error) {
+	policies := make(map[int]RetryPolicy)
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%q is not status:retries or status:retries:backoff", part)
+		}
+		code, err := parseStatusCode(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		retries, err := strconv.Atoi(fields[1])
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid retries %q for %d (must be zero or positive)", fields[1], code)
+		}
+		policy := RetryPolicy{MaxRetries: retries}
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "exponential":
+			case "fixed":
+				policy.Fixed = true
+			default:
+				return nil, fmt.Errorf("invalid backoff %q for %d (must be exponential or fixed)", fields[2], code)
+			}
+		}
+		if _, ok := policies[code]; ok {
+			return nil, fmt.Errorf("status %d is given more than once", code)
+		}
+		policies[code] = policy
+	}
+	return policies, nil
+}
+
+// validMethod reports whether method is one of the methods this tool sends
+func validMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodHead:
+		return true
+	}
+	return false
+}
+
+func methodAllowsBody(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead
+}
+
+// methodExpectsBody reports whether servers usually wait for a body with the
+// method, so that sending none is more likely a mistake than not
+func methodExpectsBody(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// worker sends requests for jobs until the channel is closed. A positive
+// delay holds the worker back before its first request, which is how -ramp-up
+// brings workers online one after the other. Each worker acts as one
+// virtual user, with -think-time it pauses between its own requests
+// independently of the global rate limiter.
+func (r *Runner) worker(ctx context.Context, jobs <-chan int, stats *workerStats, delay time.Duration) {
+	defer r.wg.Done()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	first := true
+	for range jobs {
+		if !first && r.cfg.ThinkTimeMax > 0 {
+			select {
+			case <-time.After(r.thinkTime()):
+			case <-ctx.Done():
+				return
+			}
+		}
+		first = false
+
+		r.fetch(ctx, stats)
+	}
+}
+
+// thinkTime returns how long a worker pauses between two of its requests,
+// picked uniformly from the -think-time range
+func (r *Runner) thinkTime() time.Duration {
+	if r.cfg.ThinkTimeMax == r.cfg.ThinkTimeMin {
+		return r.cfg.ThinkTimeMin
+	}
+	return r.cfg.ThinkTimeMin + time.Duration(rand.Int63n(int64(r.cfg.ThinkTimeMax-r.cfg.ThinkTimeMin)+1))
+}
+
+// parseThinkTime parses a fixed duration ("200ms") or a range ("100ms-500ms")
+func parseThinkTime(value string) (time.Duration, time.Duration, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+
+	low, err := time.ParseDuration(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := time.ParseDuration(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, err
+	}
+	if low < 0 || high < low {
+		return 0, 0, fmt.Errorf("invalid range %q", value)
+	}
+
+	return low, high, nil
+}
+
+// parseSLOBuckets parses a comma separated list of durations, in any order
+// and with repeats, into sorted distinct bounds
+func parseSLOBuckets(spec string) ([]time.Duration, error) {
+	var bounds []time.Duration
+	for _, part := range strings.Split(spec, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q is not a positive duration", strings.TrimSpace(part))
+		}
+		bounds = append(bounds, d)
+	}
+	slices.Sort(bounds)
+	return slices.Compact(bounds), nil
+}
+
+// LoadStep is one step of a load profile, sending Rate requests per second
+// for Duration
+type LoadStep struct {
+	Rate     float64
+	Duration time.Duration
+}
+
+// parseLoadProfile parses a comma separated list of steps like
+// "50rps for 30s, 200rps for 1m"
+func parseLoadProfile(spec string) ([]LoadStep, error) {
+	var steps []LoadStep
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		rateText, durationText, ok := strings.Cut(part, " for ")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in the form <rate>rps for <duration>", part)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(rateText), "rps"), 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("%q has an invalid rate, it must be positive", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(durationText))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q has an invalid duration", part)
+		}
+		steps = append(steps, LoadStep{Rate: value, Duration: d})
+	}
+	return steps, nil
+}
+
+// reportProgress rewrites a single status line on stderr every second until
+// ctx is cancelled, then clears it and closes done
+func (r *Runner) reportProgress(ctx context.Context, start time.Time, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastCompleted := int64(0)
+	lastTick := start
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprint(os.Stderr, "\r\033[K")
+			return
+		case now := <-ticker.C:
+			success, failure := r.successCount.Load(), r.failureCount.Load()
+
+			completed := success + failure
+			successRate := 0.0
+			if completed > 0 {
+				successRate = float64(success) / float64(completed) * 100
+			}
+			currentRate := float64(completed-lastCompleted) / now.Sub(lastTick).Seconds()
+			lastCompleted, lastTick = completed, now
+
+			progress := fmt.Sprintf("%d/%d", completed, r.cfg.TotalRequests)
+			if r.cfg.Duration > 0 {
+				progress = fmt.Sprintf("%d in %s/%s", completed, now.Sub(start).Round(time.Second), r.cfg.Duration)
+			}
+			fmt.Fprintf(os.Stderr, "\r\033[K%s | Success: %.2f%% | %.2f requests/second", progress, successRate, currentRate)
+		}
+	}
+}
+
+// selfStatsInterval is how often -self-stats samples the load generator.
+// Reading the memory stats stops the world briefly, so not too often.
+const selfStatsInterval = 100 * time.Millisecond
+
+// sampleSelf records the peak goroutines and heap of the load generator and
+// the garbage collections during the run, until ctx is cancelled, then done
+// is closed
+func (r *Runner) sampleSelf(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(selfStatsInterval)
+	defer ticker.Stop()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	startGC, startPause := mem.NumGC, mem.PauseTotalNs
+	stats := SelfStats{GOMAXPROCS: runtime.GOMAXPROCS(0)}
+	sample := func() {
+		runtime.ReadMemStats(&mem)
+		stats.PeakGoroutines = max(stats.PeakGoroutines, runtime.NumGoroutine())
+		stats.PeakHeap = max(stats.PeakHeap, mem.HeapAlloc)
+		stats.GCCycles = mem.NumGC - startGC
+		stats.GCPause = time.Duration(mem.PauseTotalNs - startPause)
+	}
+
+	sample()
+	for {
+		select {
+		case <-ctx.Done():
+			sample()
+			r.selfStats = stats
+			return
+		case <-ticker.C:
+			sample()
+		}
+	}
+}
+
+// sampleThroughput splits the run into windows of -qps-report and records
+// how many requests completed and failed in each one. The last, usually
+// shorter, window is taken when ctx is cancelled, then done is closed.
+func (r *Runner) sampleThroughput(ctx context.Context, start time.Time, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.cfg.QPSReport)
+	defer ticker.Stop()
+
+	lastCompleted, lastFailed := int64(0), int64(0)
+	lastTick := start
+	sample := func(now time.Time) {
+		failed := r.failureCount.Load()
+		completed := r.successCount.Load() + failed
+
+		window := ThroughputWindow{
+			Offset:   lastTick.Sub(start),
+			Requests: int(completed - lastCompleted),
+			Failures: int(failed - lastFailed),
+		}
+		if elapsed := now.Sub(lastTick).Seconds(); elapsed > 0 {
+			window.RequestRate = float64(window.Requests) / elapsed
+		}
+		if window.Requests > 0 {
+			window.ErrorRate = float64(window.Failures) / float64(window.Requests) * 100
+		}
+		r.throughput = append(r.throughput, window)
+
+		lastCompleted, lastFailed, lastTick = completed, failed, now
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if now := time.Now(); now.Sub(lastTick) > 0 {
+				sample(now)
+			}
+			return
+		case now := <-ticker.C:
+			sample(now)
+		}
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// dataSet is the content of -data-file. Every request takes the next row,
+// wrapping around to the first one when there are more requests than rows.
+type dataSet struct {
+	columns map[string]int
+	rows    [][]string
+	next    atomic.Uint64
+}
+
+// loadDataSet reads a CSV file whose first row names the columns
+func loadDataSet(path string) (*dataSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s needs a header row and at least one data row", path)
+	}
+
+	d := &dataSet{columns: make(map[string]int), rows: records[1:]}
+	for i, name := range records[0] {
+		d.columns[strings.TrimSpace(name)] = i
+	}
+
+	return d, nil
+}
+
+// dataRow is a single row of a dataSet, looked up by column name
+type dataRow struct {
+	columns map[string]int
+	values  []string
+}
+
+func (d *dataSet) nextRow() dataRow {
+	i := (d.next.Add(1) - 1) % uint64(len(d.rows))
+	return dataRow{columns: d.columns, values: d.rows[i]}
+}
+
+func (r dataRow) lookup(name string) (string, bool) {
+	i, ok := r.columns[name]
+	if !ok {
+		return "", false
+	}
+	return r.values[i], true
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// templateValues are the values placeholders of a single request expand to
+type templateValues struct {
+	row  dataRow
+	seq  int64
+	time time.Time
+}
+
+// newTemplateValues takes the next data row, if there is a -data-file, and
+// the next sequence number
+func (r *Runner) newTemplateValues() templateValues {
+	values := templateValues{seq: r.requestSeq.Add(1), time: time.Now()}
+	if r.cfg.data != nil {
+		values.row = r.cfg.data.nextRow()
+	}
+	return values
+}
+
+// expandPlaceholders replaces every placeholder in text. A {{column}} of the
+// data file takes precedence, then the built-in ones:
+//
+//	{{uuid}}          a random version 4 UUID, different for every occurrence
+//	{{randint:a:b}}   a random integer between a and b, inclusive
+//	{{seq}}           the number of the request, starting at 1
+//	{{timestamp}}     the time the request started, in Unix milliseconds
+//
+// Unknown placeholders are left as they are.
+func expandPlaceholders(text string, values templateValues) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+
+	return placeholderPattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		if value, ok := values.row.lookup(name); ok {
+			return value
+		}
+		if value, ok := values.builtin(name); ok {
+			return value
+		}
+		return match
+	})
+}
+
+func (v templateValues) builtin(name string) (string, bool) {
+	switch {
+	case name == "uuid":
+		return newUUID(), true
+	case name == "seq":
+		return strconv.FormatInt(v.seq, 10), true
+	case name == "timestamp":
+		return strconv.FormatInt(v.time.UnixMilli(), 10), true
+	case strings.HasPrefix(name, "randint:"):
+		low, high, ok := strings.Cut(strings.TrimPrefix(name, "randint:"), ":")
+		if !ok {
+			return "", false
+		}
+		from, err := strconv.ParseInt(low, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		to, err := strconv.ParseInt(high, 10, 64)
+		if err != nil || to < from {
+			return "", false
+		}
+		return strconv.FormatInt(randomBetween(from, to), 10), true
+	}
+	return "", false
+}
+
+// randomBetween returns a random integer from from to to, inclusive. A range
+// wider than rand.Int63n takes is drawn from rand.Uint64 until it fits.
+func randomBetween(from, to int64) int64 {
+	span := uint64(to) - uint64(from)
+	if span < math.MaxInt64 {
+		return from + rand.Int63n(int64(span)+1)
+	}
+	for {
+		if n := rand.Uint64(); n <= span {
+			return int64(uint64(from) + n)
+		}
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	cryptorand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// expandHeaders returns headers with placeholders expanded in their values.
+// The map is only copied when one of them has a placeholder.
+func expandHeaders(headers map[string]string, values templateValues) map[string]string {
+	var expanded map[string]string
+	for key, value := range headers {
+		if !strings.Contains(value, "{{") {
+			continue
+		}
+		if expanded == nil {
+			expanded = make(map[string]string, len(headers))
+			for k, v := range headers {
+				expanded[k] = v
+			}
+		}
+		expanded[key] = expandPlaceholders(value, values)
+	}
+	if expanded == nil {
+		return headers
+	}
+	return expanded
+}
+
+// requestRecord is the outcome of a single request
+type requestRecord struct {
+	index    int64
+	start    time.Time
+	url      string
+	method   string
+	status   int
+	latency  time.Duration
+	attempts int
+	err      error
+}
+
+// recorder writes a record of every request as it completes, for -csv and
+// -jsonl
+type recorder interface {
+	record(r requestRecord)
+	// close waits for every queued record to be written and closes the file
+	close() error
+}
+
+// openRecorders creates the -csv and -jsonl files
+func openRecorders(cfg *Config) ([]recorder, error) {
+	var recorders []recorder
+	if cfg.CSVFile != "" {
+		recorder, err := newCSVRecorder(cfg.CSVFile)
+		if err != nil {
+			return nil, fmt.Errorf("creating CSV file: %w", err)
+		}
+		recorders = append(recorders, recorder)
+	}
+	if cfg.reportDir != "" {
+		recorder, err := newCSVRecorder(filepath.Join(cfg.reportDir, "requests.csv"))
+		if err != nil {
+			for _, opened := range recorders {
+				opened.close()
+			}
+			return nil, fmt.Errorf("creating the CSV file of -report-dir: %w", err)
+		}
+		recorders = append(recorders, recorder)
+	}
+	if cfg.JSONLFile != "" {
+		recorder, err := newJSONLRecorder(cfg.JSONLFile)
+		if err != nil {
+			for _, opened := range recorders {
+				opened.close()
+			}
+			return nil, fmt.Errorf("creating JSON lines file: %w", err)
+		}
+		recorders = append(recorders, recorder)
+	}
+	return recorders, nil
+}
+
+// csvRecorder writes request records to a CSV file from a single goroutine,
+// so rows from concurrent workers never interleave
+type csvRecorder struct {
+	file    *os.File
+	writer  *csv.Writer
+	records chan requestRecord
+	done    chan struct{}
+}
+
+func newCSVRecorder(path string) (*csvRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &csvRecorder{
+		file:    file,
+		writer:  csv.NewWriter(file),
+		records: make(chan requestRecord, 1024),
+		done:    make(chan struct{}),
+	}
+	c.writer.Write([]string{"timestamp", "url", "method", "status", "latency_ms", "attempts", "error"})
+
+	go func() {
+		defer close(c.done)
+		for r := range c.records {
+			errText := ""
+			if r.err != nil {
+				errText = r.err.Error()
+			}
+			c.writer.Write([]string{
+				r.start.Format(time.RFC3339Nano),
+				r.url,
+				r.method,
+				strconv.Itoa(r.status),
+				strconv.FormatFloat(float64(r.latency.Microseconds())/1000, 'f', 3, 64),
+				strconv.Itoa(r.attempts),
+				errText,
+			})
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *csvRecorder) record(r requestRecord) {
+	c.records <- r
+}
+
+// close waits for every queued record to be written, then flushes and
+// closes the file
+func (c *csvRecorder) close() error {
+	close(c.records)
+	<-c.done
+
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+// jsonlRecorder writes request records to a file as JSON lines from a single
+// goroutine. Every line is written as soon as the request completes, so the
+// file can be followed with tail -f during the run.
+type jsonlRecorder struct {
+	file    *os.File
+	records chan requestRecord
+	done    chan struct{}
+	err     error
+}
+
+// jsonlRecord is a line of the -jsonl file
+type jsonlRecord struct {
+	Index     int64     `json:"index"`
+	Timestamp time.Time `json:"timestamp"`
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newJSONLRecorder(path string) (*jsonlRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &jsonlRecorder{
+		file:    file,
+		records: make(chan requestRecord, 1024),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(j.done)
+		encoder := json.NewEncoder(file)
+		for r := range j.records {
+			line := jsonlRecord{
+				Index:     r.index,
+				Timestamp: r.start,
+				URL:       r.url,
+				Method:    r.method,
+				Status:    r.status,
+				LatencyMs: float64(r.latency.Microseconds()) / 1000,
+				Attempts:  r.attempts,
+			}
+			if r.err != nil {
+				line.Error = r.err.Error()
+			}
+			if err := encoder.Encode(line); err != nil && j.err == nil {
+				j.err = err
+			}
+		}
+	}()
+
+	return j, nil
+}
+
+func (j *jsonlRecorder) record(r requestRecord) {
+	j.records <- r
+}
+
+func (j *jsonlRecorder) close() error {
+	close(j.records)
+	<-j.done
+
+	if j.err != nil {
+		j.file.Close()
+		return j.err
+	}
+	return j.file.Close()
+}
+
+// scenario is the content of a -scenario file
+type scenario struct {
+	Steps []scenarioStep `json:"steps"`
+}
+
+// scenarioStep is one kind of request of a -scenario. Every request picks a
+// step at random in proportion to its weight.
+type scenarioStep struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    *string           `json:"body"`
+	Weight  *int              `json:"weight"`
+}
+
+// loadScenario reads a -scenario file and makes a target of every step, its
+// path resolved against baseURL. A step without a method uses -method, one
+// without a weight has weight 1 and one without a body sends -body.
+func loadScenario(path, baseURL string) ([]Target, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s scenario
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%s has no steps", path)
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Target
+	names := make(map[string]bool)
+	for i, step := range s.Steps {
+		label := fmt.Sprintf("step %d", i+1)
+		if step.Name != "" {
+			label = fmt.Sprintf("step %d (%s)", i+1, step.Name)
+			if names[step.Name] {
+				return nil, fmt.Errorf("%s: the name is used by an earlier step", label)
+			}
+			names[step.Name] = true
+		}
+
+		if step.Path == "" {
+			return nil, fmt.Errorf("%s: path is missing", label)
+		}
+		ref, err := url.Parse(step.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid path %q", label, step.Path)
+		}
+
+		weight := 1
+		if step.Weight != nil {
+			weight = *step.Weight
+			if weight <= 0 {
+				return nil, fmt.Errorf("%s: invalid weight %d (must be a positive integer)", label, weight)
+			}
+		}
+
+		t, err := newTarget(base.ResolveReference(ref).String(), weight)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", label, err)
+		}
+
+		t.Name = step.Name
+		t.Method = strings.ToUpper(step.Method)
+		if t.Method != "" && !validMethod(t.Method) {
+			return nil, fmt.Errorf("%s: invalid method %s (must be one of GET, POST, PUT, DELETE, PATCH, HEAD)", label, step.Method)
+		}
+		if step.Body != nil {
+			if *step.Body != "" && t.Method != "" && !methodAllowsBody(t.Method) {
+				return nil, fmt.Errorf("%s: %s requests are sent without a body", label, t.Method)
+			}
+			t.Body = []byte(*step.Body)
+		}
+		for key := range step.Headers {
+			if strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("%s: empty header name", label)
+			}
+		}
+		t.Headers = step.Headers
+
+		steps = append(steps, t)
+	}
+
+	return steps, nil
+}
+
+// sitemap is the part of a sitemap.xml, or of a sitemap index that points to
+// further sitemaps, that -sitemap reads
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// loadSitemap returns up to limit URLs listed by the sitemap at sitemapURL.
+// The sitemaps of a sitemap index are followed one level deep; the ones that
+// fail to load are skipped as long as another one gave URLs.
+func loadSitemap(client *http.Client, sitemapURL string, limit int) ([]string, error) {
+	root, err := fetchSitemap(client, sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	add := func(s *sitemap) {
+		for _, u := range s.URLs {
+			if len(locations) == limit {
+				return
+			}
+			if loc := strings.TrimSpace(u.Loc); loc != "" {
+				locations = append(locations, loc)
+			}
+		}
+	}
+
+	add(root)
+	for _, child := range root.Sitemaps {
+		if len(locations) == limit {
+			break
+		}
+		s, childErr := fetchSitemap(client, strings.TrimSpace(child.Loc))
+		if childErr != nil {
+			err = childErr
+			continue
+		}
+		add(s)
+	}
+
+	if len(locations) == 0 {
+		if err == nil {
+			err = fmt.Errorf("%s lists no URLs", sitemapURL)
+		}
+		return nil, err
+	}
+	return locations, nil
+}
+
+func fetchSitemap(client *http.Client, sitemapURL string) (*sitemap, error) {
+	resp, err := client.Get(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", sitemapURL, resp.Status)
+	}
+
+	var s sitemap
+	if err := xml.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s is not a valid sitemap: %w", sitemapURL, err)
+	}
+	return &s, nil
+}
+
+// loadUserAgents reads one User-Agent per line, skipping blank lines
+func loadUserAgents(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			agents = append(agents, line)
+		}
+	}
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("%s has no user agents", path)
+	}
+	return agents, nil
+}
+
+// loadURLsFile reads the -urls-file targets. A line is the whole URL, none
+// is weighted since every URL gets its turn.
+func loadURLsFile(path string) ([]Target, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []Target
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := newTarget(line, 1)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		listed = append(listed, t)
+	}
+	if len(listed) == 0 {
+		return nil, fmt.Errorf("%s has no URLs", path)
+	}
+	return listed, nil
+}
+
+// pickUserAgent returns a random one of the configured user agents, or ""
+// to leave Go's default (or a -H User-Agent) in place
+func (r *Runner) pickUserAgent() string {
+	if len(r.cfg.UserAgents) == 0 {
+		return ""
+	}
+	return r.cfg.UserAgents[rand.Intn(len(r.cfg.UserAgents))]
+}
+
+func loadHeaders(filename string) (map[string]string, error) {
+	var headers map[string]string
+
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return headers, nil
+}
+
+// loadConfigFile sets every flag named in the JSON object in path, except the
+// given ones, so that the command line wins over the file. Repeatable flags
+// take a list, e.g. {"url": ["http://a/", "http://b/"], "H": ["X-Env: test"]}.
+// A .yaml or .yml file is read with parseFlatYAML instead.
+// The flags it sets count as given, the same as on the command line.
+func loadConfigFile(path string, given map[string]bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]any
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if settings, err = parseFlatYAML(content); err != nil {
+			return err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&settings); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if given[name] {
+			continue
+		}
+
+		values, ok := settings[name].([]any)
+		if !ok {
+			values = []any{settings[name]}
+		}
+		for _, value := range values {
+			var text string
+			switch v := value.(type) {
+			case string:
+				text = v
+			case json.Number:
+				text = v.String()
+			case bool:
+				text = strconv.FormatBool(v)
+			default:
+				return fmt.Errorf("invalid value %v for -%s: must be a string, number, boolean or a list of them", value, name)
+			}
+			if err := flag.Set(name, text); err != nil {
+				return fmt.Errorf("invalid value %q for -%s: %v", text, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseFlatYAML reads the YAML that -config takes: a "name: value" line per
+// flag, with the items of a repeatable flag on "- value" lines below a bare
+// "name:". Values may be quoted, and " #" starts a comment outside of quotes.
+// Nothing else of YAML is supported, the values are strings for flag.Set.
+func parseFlatYAML(content []byte) (map[string]any, error) {
+	settings := make(map[string]any)
+	var list string
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok {
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item without a name: above it", i+1)
+			}
+			value, err := yamlScalar(item)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			settings[list] = append(settings[list].([]any), value)
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("line %d: only lists may be indented", i+1)
+		}
+
+		name, value, ok := strings.Cut(trimmed, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: want name: value", i+1)
+		}
+		if _, seen := settings[name]; seen {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, name)
+		}
+		list = ""
+		if value = strings.TrimSpace(value); value == "" {
+			list = name
+			settings[name] = []any{}
+			continue
+		}
+		scalar, err := yamlScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		settings[name] = scalar
+	}
+	return settings, nil
+}
+
+// yamlScalar unquotes a single or double quoted YAML value, or takes a plain
+// one up to a comment
+func yamlScalar(value string) (string, error) {
+	if value[0] != '"' && value[0] != '\'' {
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	// The closing quote is the first one that is not escaped, by a
+	// backslash in double quotes or by doubling it in single quotes
+	quote := value[0]
+	end := -1
+	for i := 1; i < len(value) && end < 0; i++ {
+		switch {
+		case quote == '"' && value[i] == '\\':
+			i++
+		case value[i] == quote && quote == '\'' && i+1 < len(value) && value[i+1] == '\'':
+			i++
+		case value[i] == quote:
+			end = i
+		}
+	}
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+	if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %s after string", rest)
+	}
+	if quote == '"' {
+		return strconv.Unquote(value[:end+1])
+	}
+	return strings.ReplaceAll(value[1:end], "''", "'"), nil
+}
+
+// sortedDurations returns a sorted copy of durations, leaving the original untouched
+func sortedDurations(durations []time.Duration) []time.Duration {
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return sorted
+}
+
+// calculatePercentile expects durations to be sorted in ascending order
+func calculatePercentile(durations []time.Duration, percentile float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	index := int(math.Ceil(percentile/100.0*float64(len(durations)))) - 1
+	return durations[index]
+}
+
+// newTransport builds the transport shared by all workers. The default
+// transport keeps only 2 idle connections per host, which would force most
+// requests onto a fresh connection when hammering a single host.
+func newTransport(cfg *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = cfg.Concurrency
+	}
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+
+	if len(cfg.LocalAddrs) > 0 {
+		transport.DialContext = localAddrDialer(cfg.LocalAddrs)
+	}
+
+	// Only the address that is dialed changes, the Host header and the TLS
+	// server name stay those of the URL. Through a proxy it does not apply,
+	// the proxy resolves the host.
+	if len(cfg.Resolve) > 0 {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if to, ok := cfg.Resolve[strings.ToLower(addr)]; ok {
+				addr = to
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+
+	// Every host:port leads to the socket, a proxy would not reach it
+	if cfg.UnixSocket != "" {
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", cfg.UnixSocket)
+		}
+		transport.Proxy = nil
+	}
+
+	// fetch asks for compressed bodies itself and decodes them in
+	// responseBody, so that it can count the bytes on the wire
+	transport.DisableCompression = true
+
+	// Without -proxy the cloned transport keeps honoring HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY through http.ProxyFromEnvironment
+	if cfg.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.ProxyURL)
+	}
+
+	transport.TLSClientConfig = cfg.TLSConfig
+
+	// A non-nil, empty TLSNextProto stops the transport from negotiating h2
+	if !cfg.HTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	// Without keep-alive no connection is ever idle, so the pool settings
+	// above have nothing to apply to
+	if cfg.DisableKeepAlive {
+		transport.DisableKeepAlives = true
+		transport.MaxIdleConns = 0
+		transport.MaxIdleConnsPerHost = -1
+	}
+
+	return transport
+}
+
+// NamedBody is one of the bodies of -body-dir, named after its file
+type NamedBody struct {
+	Name string
+	Data []byte
+}
+
+// loadBodyDir reads every file of dir, in the order of their names. Hidden
+// files and subdirectories are skipped.
+func loadBodyDir(dir string) ([]NamedBody, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bodies []NamedBody
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, NamedBody{Name: entry.Name(), Data: data})
+	}
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("%s has no files", dir)
+	}
+	return bodies, nil
+}
+
+// pickBody returns the index of the body of -body-dir the next request sends
+func (r *Runner) pickBody() int {
+	if r.cfg.RandomBodies {
+		return rand.Intn(len(r.cfg.Bodies))
+	}
+	return int((r.nextBody.Add(1) - 1) % uint64(len(r.cfg.Bodies)))
+}
+
+// readBodyFile reads the -body-file, "-" being stdin. Stdin is read to the end
+// before the run starts so the body can be resent by every request.
+func readBodyFile(path string) ([]byte, error) {
+	if path != "-" {
+		return os.ReadFile(path)
+	}
+	if isTerminal(os.Stdin) {
+		return nil, errors.New("stdin is a terminal, pipe the body in, e.g. cat payload.json | go run ./cmd/stress -body-file - <url>")
+	}
+	return io.ReadAll(os.Stdin)
+}
+
+// formBody encodes key=value fields as application/x-www-form-urlencoded,
+// which is also how -query is encoded.
+// Placeholders are left as they are so that every request can fill them in.
+func formBody(fields []string) ([]byte, error) {
+	var body strings.Builder
+	for i, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q must be in the form key=value", field)
+		}
+		if i > 0 {
+			body.WriteByte('&')
+		}
+		body.WriteString(escapeFormValue(key))
+		body.WriteByte('=')
+		body.WriteString(escapeFormValue(value))
+	}
+	return []byte(body.String()), nil
+}
+
+// addQuery appends an encoded query to the one rawURL already has. The URL
+// is not parsed and put back together, which could escape placeholders in it.
+func addQuery(rawURL, query string) string {
+	base, fragment, hasFragment := strings.Cut(rawURL, "#")
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+		if strings.HasSuffix(base, "?") || strings.HasSuffix(base, "&") {
+			separator = ""
+		}
+	}
+	base += separator + query
+	if hasFragment {
+		base += "#" + fragment
+	}
+	return base
+}
+
+// escapeFormValue escapes text for a form body except for its placeholders
+func escapeFormValue(text string) string {
+	var escaped strings.Builder
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringIndex(text, -1) {
+		escaped.WriteString(url.QueryEscape(text[last:match[0]]))
+		escaped.WriteString(text[match[0]:match[1]])
+		last = match[1]
+	}
+	escaped.WriteString(url.QueryEscape(text[last:]))
+	return escaped.String()
+}
+
+// multipartBody builds a multipart/form-data body from key=value fields and
+// field=path files, and returns it with its Content-Type. The files are read
+// once here, so every request and retry sends the same bytes.
+func multipartBody(fields, files []string) ([]byte, string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, "", fmt.Errorf("-form %q must be in the form key=value", field)
+		}
+		if err := mw.WriteField(key, value); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, file := range files {
+		key, path, ok := strings.Cut(file, "=")
+		if !ok || key == "" || path == "" {
+			return nil, "", fmt.Errorf("-multipart-file %q must be in the form field=path", file)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		part, err := mw.CreateFormFile(key, filepath.Base(path))
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), mw.FormDataContentType(), nil
+}
+
+// checkWritableDir creates dir if it does not exist yet and makes sure files
+// can be created in it, before the run rather than once it is over
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// writeReport writes the bundle of -report-dir next to the requests.csv
+// the run already wrote there: summary.json as -output json prints it,
+// histogram.txt with the latency histogram of every run and flags.json with
+// the flags that were used, in the format of -config
+func writeReport(dir string, runs []Results, targetArg string) error {
+	var summary any = runs[0]
+	if len(runs) > 1 {
+		summary = repeatResults{runs, summarizeRuns(runs)}
+	}
+	if err := writeReportFile(filepath.Join(dir, "summary.json"), func(out io.Writer) error {
+		return writeJSON(out, summary)
+	}); err != nil {
+		return err
+	}
+
+	if err := writeReportFile(filepath.Join(dir, "histogram.txt"), func(out io.Writer) error {
+		for i, results := range runs {
+			if len(runs) > 1 {
+				if i > 0 {
+					fmt.Fprintln(out)
+				}
+				fmt.Fprintf(out, "Run %d\n", i+1)
+			}
+			printHistogram(out, results.Histogram, 80)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return writeReportFile(filepath.Join(dir, "flags.json"), func(out io.Writer) error {
+		return writeJSON(out, usedFlags(targetArg))
+	})
+}
+
+func writeReportFile(path string, write func(out io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// usedFlags lists every flag that differs from its default, whether it came
+// from the command line or -config, so that -config can replay the run.
+// targetArg, the URL given as the last argument, is listed as a -url.
+// Credentials are redacted.
+func usedFlags(targetArg string) map[string]any {
+	used := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "report-dir":
+			return
+		case "bearer", "basic-auth", "hmac-secret":
+			if f.Value.String() != "" {
+				used[f.Name] = "[redacted]"
+			}
+			return
+		case "proxy":
+			if f.Value.String() != "" {
+				used[f.Name] = redactURL(f.Value.String())
+			}
+			return
+		case "url":
+			var urls []string
+			if targetArg != "" {
+				urls = append(urls, targetArg)
+			}
+			for _, value := range *f.Value.(*listFlag) {
+				rawURL, weight, weighted := strings.Cut(value, " ")
+				if weighted {
+					urls = append(urls, redactURL(rawURL)+" "+weight)
+				} else {
+					urls = append(urls, redactURL(rawURL))
+				}
+			}
+			if len(urls) > 0 {
+				used[f.Name] = urls
+			}
+			return
+		case "cookie":
+			// Seeded cookies are mostly sessions, only their names are kept
+			var cookies []string
+			for _, value := range *f.Value.(*listFlag) {
+				name, _, _ := strings.Cut(value, "=")
+				cookies = append(cookies, name+"=[redacted]")
+			}
+			if len(cookies) > 0 {
+				used[f.Name] = cookies
+			}
+			return
+		}
+		switch value := f.Value.(type) {
+		case *listFlag:
+			if len(*value) > 0 {
+				used[f.Name] = []string(*value)
+			}
+		case headerFlag:
+			var headers []string
+			for key, v := range value {
+				if slices.Contains(redactedHeaders, http.CanonicalHeaderKey(key)) {
+					v = "[redacted]"
+				}
+				headers = append(headers, key+": "+v)
+			}
+			sort.Strings(headers)
+			if len(headers) > 0 {
+				used[f.Name] = headers
+			}
+		default:
+			if f.Value.String() != f.DefValue {
+				used[f.Name] = f.Value.String()
+			}
+		}
+	})
+	return used
+}
+
+// localAddrDialer returns a DialContext that binds every new connection to
+// the next of addrs in turn. The dialers keep the timeouts of
+// http.DefaultTransport.
+func localAddrDialer(addrs []net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialers := make([]*net.Dialer, len(addrs))
+	for i, ip := range addrs {
+		dialers[i] = &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: &net.TCPAddr{IP: ip},
+		}
+	}
+
+	var next atomic.Uint64
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := dialers[(next.Add(1)-1)%uint64(len(dialers))]
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// parseLocalAddrs parses a comma separated list of local IP addresses and
+// checks that each of them can be bound on this machine
+func parseLocalAddrs(value string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, part := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(part))
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", strings.TrimSpace(part))
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an address of this machine: %w", ip, err)
+		}
+		listener.Close()
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseResolve parses -resolve entries like curl's --resolve, host:port:ip,
+// into the address to connect to per host:port. An IPv6 address goes in
+// brackets, e.g. example.com:443:[2001:db8::1].
+func parseResolve(values []string) (map[string]string, error) {
+	resolve := make(map[string]string, len(values))
+	for _, value := range values {
+		host, rest, _ := strings.Cut(value, ":")
+		port, ip, _ := strings.Cut(rest, ":")
+		if host == "" || port == "" || ip == "" {
+			return nil, fmt.Errorf("%q must be in the form host:port:ip", value)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("%q has an invalid port %q", value, port)
+		}
+		parsed := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]"))
+		if parsed == nil {
+			return nil, fmt.Errorf("%q is not an IP address", ip)
+		}
+		resolve[net.JoinHostPort(strings.ToLower(host), port)] = net.JoinHostPort(parsed.String(), port)
+	}
+	return resolve, nil
+}
+
+// parseTLSVersion turns "1.2" into tls.VersionTLS12
+func parseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("%q is not a TLS version (must be 1.0, 1.1, 1.2 or 1.3)", value)
+}
+
+// parseFlags reads the command line into a Config and exits with a usage
+// message when settings are missing or invalid
+func parseFlags() *Config {
+	defaults := DefaultConfig()
+	cfg := &defaults
+	var requestBody, bodyFile, headersFile string
+	extraHeaders := make(map[string]string)
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: go run ./cmd/stress [flags] <url>\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
+	var urls listFlag
+	flag.Var(&urls, "url", "target URL, optionally weighted as \"URL weight\" (repeatable, may also be given as the last argument)")
+	flag.IntVar(&cfg.TotalRequests, "n", cfg.TotalRequests, "total number of requests to send")
+	flag.IntVar(&cfg.Concurrency, "c", cfg.Concurrency, "maximum number of concurrent requests")
+	flag.DurationVar(&cfg.Duration, "d", 0, "keep sending requests for this long (e.g. 30s, 2m) instead of a fixed count")
+	flag.DurationVar(&cfg.Duration, "duration", 0, "same as -d")
+	flag.Float64Var(&cfg.RequestRate, "rate", cfg.RequestRate, "maximum requests per second across all workers (0 means unlimited)")
+	loadProfile := flag.String("load-profile", "", "run steps of their own rate and duration instead of -rate and -d, e.g. \"50rps for 30s, 200rps for 1m\"")
+	flag.IntVar(&cfg.Burst, "burst", cfg.Burst, "number of requests allowed to go out at once before -rate applies")
+	flag.StringVar(&cfg.Method, "method", cfg.Method, "HTTP method to use (GET, POST, PUT, DELETE, PATCH, HEAD)")
+	flag.StringVar(&requestBody, "body", "", "request body to send")
+	flag.BoolVar(&cfg.Chunked, "chunked", false, "send the request body with chunked transfer encoding instead of a Content-Length")
+	allowEmptyBody := flag.Bool("allow-empty-body", false, "do not warn about POST, PUT or PATCH requests without a body")
+	flag.StringVar(&bodyFile, "body-file", "", "file containing the request body to send, - reads it from stdin")
+	bodyDir := flag.String("body-dir", "", "directory whose files are sent as the request body, one per request")
+	bodyOrder := flag.String("body-order", "round-robin", "order -body-dir bodies are sent in: round-robin or random")
+	var queryParams listFlag
+	flag.Var(&queryParams, "query", "query parameter to add to every URL as key=value (repeatable), after the ones the URL already has")
+	var formFields, multipartFiles listFlag
+	flag.Var(&formFields, "form", "form field to send as key=value, encoded as application/x-www-form-urlencoded (repeatable)")
+	flag.Var(&multipartFiles, "multipart-file", "file to upload as field=path, sent with the -form fields as multipart/form-data (repeatable)")
+	flag.StringVar(&cfg.outputFormat, "output", cfg.outputFormat, "summary format: text, json or prom (Prometheus text exposition)")
+	expectStatusSpec := flag.String("expect-status", "200-299", "status codes counted as success, e.g. 200, 200,201,204 or 200-299")
+	flag.StringVar(&headersFile, "headers", "", "JSON file with headers to add to every request")
+	flag.Var(headerFlag(extraHeaders), "H", "header to add to every request as \"Key: Value\" (repeatable, wins over -headers)")
+	flag.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "timeout for each request attempt")
+	flag.DurationVar(&cfg.BodyReadTimeout, "body-read-timeout", 0, "fail requests whose response body, when it is read, takes longer than this after the headers (0 leaves it to -timeout)")
+	flag.IntVar(&cfg.MaxRetries, "retries", cfg.MaxRetries, "how many times a timed out or refused request is retried (0 disables retries)")
+	flag.DurationVar(&cfg.RetryBackoff, "retry-backoff", 0, "delay before the first retry, doubled for every further retry")
+	flag.BoolVar(&cfg.RetryOn5xx, "retry-on-5xx", false, "also retry requests that got a 5xx response")
+	retryPolicy := flag.String("retry-policy", "", "per status retries as status:retries[:exponential|fixed], comma separated, e.g. 429:3:exponential,503:2:fixed,404:0; a 429 or 503 waits for its Retry-After, up to -timeout")
+	flag.BoolVar(&cfg.SelfStats, "self-stats", false, "report the peak goroutines and heap and the garbage collections of the load generator itself")
+	flag.BoolVar(&cfg.Quiet, "quiet", false, "do not show the live progress line or the latency histogram")
+	flag.IntVar(&cfg.Bootstrap, "bootstrap", 0, "resamples of the response times to estimate a 95% confidence interval of every percentile with, e.g. 1000 (0 disables)")
+	sloSpec := flag.String("slo-buckets", "", "comma separated response times to report the percentage of requests under, e.g. 100ms,250ms,1s")
+	flag.IntVar(&cfg.HistBuckets, "hist-buckets", cfg.HistBuckets, "number of buckets of the latency histogram in the summary (0 disables it)")
+	flag.DurationVar(&cfg.RampUp, "ramp-up", 0, "bring workers online gradually over this long instead of all at once")
+	flag.DurationVar(&cfg.StartJitter, "start-jitter", 0, "delay the first request of every worker by a random time up to this long")
+	flag.StringVar(&cfg.ExpectBodyContains, "expect-body-contains", "", "fail requests whose response body does not contain this text")
+	var expectHeaders listFlag
+	flag.Var(&expectHeaders, "expect-header", "header every response must have, as \"Name: value\" for an exact value or \"Name\" (repeatable)")
+	bodyRegex := flag.String("expect-body-regex", "", "fail requests whose response body does not match this regular expression")
+	flag.BoolVar(&cfg.SSE, "sse", false, "treat responses as Server-Sent Events streams: keep each open for -sse-duration and count the events")
+	flag.DurationVar(&cfg.SSEDuration, "sse-duration", 10*time.Second, "how long every -sse stream is kept open")
+	flag.BoolVar(&cfg.ReadBody, "read-body", cfg.ReadBody, "read every response body to the end so connections can be reused")
+	flag.IntVar(&cfg.MaxIdleConns, "max-idle-conns", 0, "maximum idle connections kept open across all hosts (0 means no limit)")
+	flag.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "maximum idle connections kept open per host (0 means the -c value)")
+	flag.DurationVar(&cfg.IdleConnTimeout, "idle-conn-timeout", cfg.IdleConnTimeout, "how long an idle connection is kept open")
+	flag.BoolVar(&cfg.DisableKeepAlive, "disable-keepalive", false, "open a new connection for every request")
+	flag.BoolVar(&cfg.HTTP2, "http2", cfg.HTTP2, "allow HTTP/2 over TLS, -http2=false forces HTTP/1.1")
+	basicAuth := flag.String("basic-auth", "", "send HTTP basic authentication as user:password")
+	flag.StringVar(&cfg.HMACSecret, "hmac-secret", "", "secret to sign the body of every request with, the signature goes in -hmac-header")
+	flag.StringVar(&cfg.HMACHeader, "hmac-header", cfg.HMACHeader, "header to send the hex encoded HMAC signature in")
+	hmacAlgo := flag.String("hmac-algo", "sha256", "hash of the HMAC signature: sha1, sha256 or sha512")
+	flag.StringVar(&cfg.HMACTimestampHeader, "hmac-timestamp-header", "", "header to send the Unix time in, which is then signed along with the body as \"<timestamp>.<body>\"")
+	flag.StringVar(&cfg.BearerToken, "bearer", "", "send an \"Authorization: Bearer\" header with this token")
+	proxy := flag.String("proxy", "", "send requests through this proxy, e.g. http://host:port (defaults to HTTP_PROXY/HTTPS_PROXY)")
+	flag.BoolVar(&cfg.TLSConfig.InsecureSkipVerify, "insecure", false, "skip TLS certificate verification")
+	caCert := flag.String("cacert", "", "PEM file with CA certificates to trust instead of the system pool")
+	clientCert := flag.String("client-cert", "", "PEM file with the client certificate for mutual TLS, needs -client-key")
+	clientKey := flag.String("client-key", "", "PEM file with the private key of -client-cert")
+	flag.BoolVar(&cfg.Trace, "trace", false, "time the DNS, connect and TLS phases and the time to first byte of every request (adds some overhead)")
+	flag.StringVar(&cfg.CSVFile, "csv", "", "write one row per request to this CSV file")
+	flag.StringVar(&cfg.JSONLFile, "jsonl", "", "write one JSON object per request to this file as each request completes")
+	thinkTimeSpec := flag.String("think-time", "", "pause of every worker between its requests, fixed (200ms) or random in a range (100ms-500ms)")
+	flag.BoolVar(&cfg.UseCookies, "cookies", false, "keep cookies set by responses and send them on later requests")
+	var seedCookies listFlag
+	flag.Var(&seedCookies, "cookie", "cookie to start with as name=value (repeatable, implies -cookies)")
+	flag.IntVar(&cfg.MaxRedirects, "max-redirects", cfg.MaxRedirects, "redirects to follow per request, 0 records the 3xx response as-is")
+	flag.IntVar(&cfg.Warmup, "warmup", 0, "requests to send before the measured run, excluded from all results")
+	flag.IntVar(&cfg.PrewarmConns, "prewarm-conns", 0, "connections to open to every host before the measured run so they are ready in the pool")
+	dataFile := flag.String("data-file", "", "CSV file whose columns fill {{column}} placeholders in the URL, headers and body, one row per request")
+	verbose := flag.Bool("v", false, "log every request attempt to stderr")
+	flag.BoolVar(verbose, "verbose", false, "same as -v")
+	veryVerbose := flag.Bool("vv", false, "like -v, also log request and response headers")
+	flag.Float64Var(&cfg.failIfSuccessRateBelow, "fail-if-success-rate-below", 0, "exit with code 1 when the success rate in percent is below this")
+	flag.DurationVar(&cfg.failIfP99Above, "fail-if-p99-above", 0, "exit with code 1 when the 99th percentile response time is above this")
+	flag.DurationVar(&cfg.QPSReport, "qps-report", 0, "report throughput and error rate over windows of this length (e.g. 1s)")
+	flag.BoolVar(&cfg.NoCompression, "no-compression", false, "do not ask for gzip or deflate compressed responses")
+	flag.Float64Var(&cfg.PerHostRate, "per-host-rate", 0, "maximum requests per second to each host:port, on top of -rate (0 means unlimited)")
+	flag.StringVar(&cfg.Sitemap, "sitemap", "", "fetch this sitemap.xml and add the URLs it lists as targets")
+	flag.IntVar(&cfg.SitemapLimit, "sitemap-limit", cfg.SitemapLimit, "maximum number of URLs to take from -sitemap")
+	urlsFile := flag.String("urls-file", "", "file with one URL per line to send requests to in turn, blank lines and # comments are skipped")
+	flag.StringVar(&cfg.IfNoneMatch, "if-none-match", "", "entity tag to send as the If-None-Match header of every request; 304 responses then count as success unless -expect-status is given")
+	flag.StringVar(&cfg.TraceHeader, "trace-header", "", "header to send a unique UUID in with every request, e.g. X-Request-ID")
+	userAgent := flag.String("user-agent", "", "User-Agent header to send instead of Go's default")
+	userAgentsFile := flag.String("user-agents-file", "", "file with one User-Agent per line, every request picks one at random")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "print the request that would be sent to every URL and exit without sending anything")
+	var resolve listFlag
+	flag.StringVar(&cfg.UnixSocket, "unix-socket", "", "send every request over this Unix domain socket, the URL gives the path and the Host header")
+	flag.Var(&resolve, "resolve", "connect to this address for a host:port instead of looking it up, as host:port:ip (repeatable)")
+	localAddr := flag.String("local-addr", "", "local IP address to send from, a comma separated list is used round-robin per connection")
+	flag.StringVar(&cfg.pprofAddr, "pprof", "", "serve net/http/pprof on this address during the run, e.g. :6060")
+	minTLS := flag.String("min-tls", "", "lowest TLS version to offer: 1.0, 1.1, 1.2 or 1.3")
+	maxTLS := flag.String("max-tls", "", "highest TLS version to offer: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&cfg.SaveFailures, "save-failures", "", "directory to write the status, headers and body of failed requests to")
+	flag.IntVar(&cfg.SaveLimit, "save-limit", cfg.SaveLimit, "maximum number of failed requests -save-failures writes")
+	scenarioFile := flag.String("scenario", "", "JSON file with weighted request steps (method, path, headers, body) to mix, relative to the URL")
+	flag.IntVar(&cfg.MaxErrors, "max-errors", 0, "stop the run after this many failed requests in a row (0 disables)")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", 0, "once no more requests are sent, wait this long for the ones in flight before canceling them (0 waits for them)")
+	flag.DurationVar(&cfg.MaxDuration, "max-duration", 0, "end the run after this long however many requests were sent, canceling the ones in flight (0 disables)")
+	flag.Float64Var(&cfg.MaxErrorRate, "max-error-rate", 0, "stop the run once more than this percentage of requests failed, checked after 20 requests (0 disables)")
+	baselineFile := flag.String("baseline", "", "JSON results of an earlier run (-output json) to compare this one with, regressions make the exit code 1")
+	flag.Float64Var(&cfg.regressionThreshold, "regression-threshold", 10, "percent a percentile may grow, or percentage points the success rate may drop, against -baseline")
+	flag.BoolVar(&cfg.noSummaryOnEmpty, "no-summary-on-empty", true, "print a short failure report instead of the summary when no request succeeded")
+	flag.BoolVar(&cfg.findMaxThroughput, "find-max-throughput", false, "raise the concurrency in steps up to -c, each for -d, and report where the throughput stops growing")
+	flag.IntVar(&cfg.concurrencyStep, "concurrency-step", 10, "how much -find-max-throughput raises the concurrency by at every step")
+	flag.Float64Var(&cfg.kneeErrorRate, "knee-error-rate", 1, "error rate in percent above which -find-max-throughput stops")
+	noColor := flag.Bool("no-color", false, "do not color the summary, it is only colored on a terminal and without NO_COLOR anyway")
+	flag.BoolVar(&cfg.compareHosts, "compare-hosts", false, "send the same load to two -url targets at once and print their results side by side")
+	flag.StringVar(&cfg.reportDir, "report-dir", "", "directory to write a report of the run to: JSON summary, per request CSV, latency histogram and the flags used")
+	flag.IntVar(&cfg.repeat, "repeat", cfg.repeat, "run the whole test this many times and summarize the spread across runs")
+	configFile := flag.String("config", "", "JSON or YAML (.yaml, .yml) file with flag values keyed by flag name, flags on the command line win over it")
+	flag.Parse()
+
+	// A non-flag argument is the URL, flags given after it are still parsed.
+	// It is taken as it is, without a weight.
+	var positionalURL string
+	if flag.NArg() > 0 && len(urls) == 0 {
+		positionalURL = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if *configFile != "" {
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		if positionalURL != "" {
+			given["url"] = true
+		}
+		if err := loadConfigFile(*configFile, given); err != nil {
+			fmt.Println("Invalid -config:", err)
+			os.Exit(1)
+		}
+	}
+
+	if (len(urls) == 0 && positionalURL == "" && cfg.Sitemap == "" && *urlsFile == "") || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if positionalURL != "" {
+		t, err := newTarget(positionalURL, 1)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.Targets = append(cfg.Targets, t)
+		cfg.targetArg = positionalURL
+	}
+	for _, value := range urls {
+		t, err := parseTarget(value)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.Targets = append(cfg.Targets, t)
+	}
+
+	if *urlsFile != "" {
+		listed, err := loadURLsFile(*urlsFile)
+		if err != nil {
+			fmt.Println("Invalid -urls-file:", err)
+			os.Exit(1)
+		}
+		cfg.Targets = append(cfg.Targets, listed...)
+		cfg.RoundRobin = true
+	}
+
+	if *scenarioFile != "" {
+		if len(cfg.Targets) != 1 || cfg.Sitemap != "" {
+			fmt.Println("-scenario needs exactly one base URL, given with -url or as the last argument, and no -sitemap")
+			os.Exit(1)
+		}
+		steps, err := loadScenario(*scenarioFile, cfg.Targets[0].URL)
+		if err != nil {
+			fmt.Println("Invalid -scenario:", err)
+			os.Exit(1)
+		}
+		cfg.Targets = steps
+	}
+
+	// Both URLs get every other request, unless their weights split the
+	// load otherwise
+	if cfg.compareHosts {
+		if len(cfg.Targets) != 2 || *urlsFile != "" || *scenarioFile != "" || cfg.Sitemap != "" {
+			fmt.Println("-compare-hosts needs exactly two -url targets, and no -urls-file, -scenario or -sitemap")
+			os.Exit(1)
+		}
+		cfg.RoundRobin = cfg.Targets[0].Weight == cfg.Targets[1].Weight
+	}
+
+	if len(queryParams) > 0 {
+		query, err := formBody(queryParams)
+		if err != nil {
+			fmt.Println("Invalid -query:", err)
+			os.Exit(1)
+		}
+		for i := range cfg.Targets {
+			cfg.Targets[i].URL = addQuery(cfg.Targets[i].URL, string(query))
+		}
+	}
+
+	if cfg.TotalRequests <= 0 {
+		fmt.Printf("Invalid number of requests: %d (must be a positive integer)\n", cfg.TotalRequests)
+		os.Exit(1)
+	}
+
+	if cfg.Concurrency <= 0 {
+		fmt.Printf("Invalid concurrency: %d (must be a positive integer)\n", cfg.Concurrency)
+		os.Exit(1)
+	}
+
+	if cfg.outputFormat != "text" && cfg.outputFormat != "json" && cfg.outputFormat != "prom" {
+		fmt.Printf("Invalid output format: %s (must be text, json or prom)\n", cfg.outputFormat)
+		os.Exit(1)
+	}
+
+	var err error
+	cfg.ExpectStatus, err = ParseStatusSpec(*expectStatusSpec)
+	if err != nil {
+		fmt.Println("Invalid -expect-status:", err)
+		os.Exit(1)
+	}
+
+	// A 304 is what a conditional request hopes for
+	if cfg.IfNoneMatch != "" {
+		statusGiven := false
+		flag.Visit(func(f *flag.Flag) { statusGiven = statusGiven || f.Name == "expect-status" })
+		if !statusGiven {
+			cfg.ExpectStatus = append(cfg.ExpectStatus, statusRange{from: http.StatusNotModified, to: http.StatusNotModified})
+		}
+	}
+
+	for _, spec := range expectHeaders {
+		expected, err := parseHeaderExpectation(spec)
+		if err != nil {
+			fmt.Println("Invalid -expect-header:", err)
+			os.Exit(1)
+		}
+		cfg.ExpectHeaders = append(cfg.ExpectHeaders, expected)
+	}
+
+	if *bodyRegex != "" {
+		cfg.ExpectBodyRegex, err = regexp.Compile(*bodyRegex)
+		if err != nil {
+			fmt.Println("Invalid -expect-body-regex:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Duration < 0 {
+		fmt.Printf("Invalid duration: %s (must be positive)\n", cfg.Duration)
+		os.Exit(1)
+	}
+
+	// Every level of the search runs for -d, as fast as it can unless -rate
+	// was given
+	if cfg.findMaxThroughput {
+		if *loadProfile != "" || cfg.repeat > 1 || cfg.compareHosts {
+			fmt.Println("-find-max-throughput cannot be combined with -load-profile, -repeat or -compare-hosts")
+			os.Exit(1)
+		}
+		if cfg.concurrencyStep <= 0 {
+			fmt.Printf("Invalid concurrency step: %d (must be a positive integer)\n", cfg.concurrencyStep)
+			os.Exit(1)
+		}
+		if cfg.kneeErrorRate < 0 || cfg.kneeErrorRate > 100 {
+			fmt.Printf("Invalid knee error rate: %g (must be between 0 and 100)\n", cfg.kneeErrorRate)
+			os.Exit(1)
+		}
+		if cfg.Duration == 0 {
+			cfg.Duration = 10 * time.Second
+		}
+		rateGiven := false
+		flag.Visit(func(f *flag.Flag) { rateGiven = rateGiven || f.Name == "rate" })
+		if !rateGiven {
+			cfg.RequestRate = 0
+		}
+	}
+
+	if *loadProfile != "" {
+		if cfg.Duration > 0 {
+			fmt.Println("Only one of -load-profile and -d can be given, the profile sets how long the run takes")
+			os.Exit(1)
+		}
+		cfg.LoadProfile, err = parseLoadProfile(*loadProfile)
+		if err != nil {
+			fmt.Println("Invalid -load-profile:", err)
+			os.Exit(1)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "rate" {
+				fmt.Fprintln(os.Stderr, "Warning: -rate is ignored, -load-profile sets the rate of every step")
+			}
+		})
+	}
+
+	if cfg.Duration > 0 {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "n" {
+				fmt.Fprintln(os.Stderr, "Warning: both -n and -d were given, running for", cfg.Duration, "and ignoring -n")
+			}
+		})
+	}
+
+	if cfg.RequestRate < 0 {
+		fmt.Printf("Invalid rate: %g (must be zero or positive)\n", cfg.RequestRate)
+		os.Exit(1)
+	}
+
+	if cfg.Burst <= 0 {
+		fmt.Printf("Invalid burst: %d (must be a positive integer)\n", cfg.Burst)
+		os.Exit(1)
+	}
+
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if !validMethod(cfg.Method) {
+		fmt.Printf("Invalid method: %s (must be one of GET, POST, PUT, DELETE, PATCH, HEAD)\n", cfg.Method)
+		os.Exit(1)
+	}
+
+	if requestBody != "" && bodyFile != "" {
+		fmt.Println("Only one of -body and -body-file can be given")
+		os.Exit(1)
+	}
+
+	if (len(formFields) > 0 || len(multipartFiles) > 0) && (requestBody != "" || bodyFile != "") {
+		fmt.Println("-form and -multipart-file build the body themselves and cannot be combined with -body or -body-file")
+		os.Exit(1)
+	}
+
+	if *bodyDir != "" {
+		if requestBody != "" || bodyFile != "" || len(formFields) > 0 || len(multipartFiles) > 0 || *scenarioFile != "" {
+			fmt.Println("-body-dir cannot be combined with -body, -body-file, -form, -multipart-file or -scenario")
+			os.Exit(1)
+		}
+		cfg.Bodies, err = loadBodyDir(*bodyDir)
+		if err != nil {
+			fmt.Println("Invalid -body-dir:", err)
+			os.Exit(1)
+		}
+	}
+	switch *bodyOrder {
+	case "round-robin":
+	case "random":
+		cfg.RandomBodies = true
+	default:
+		fmt.Printf("Invalid body order: %s (must be round-robin or random)\n", *bodyOrder)
+		os.Exit(1)
+	}
+
+	var bodyContentType string
+	switch {
+	case bodyFile != "":
+		data, err := readBodyFile(bodyFile)
+		if err != nil {
+			fmt.Println("Error reading body file:", err)
+			os.Exit(1)
+		}
+		cfg.Body = data
+	case len(multipartFiles) > 0:
+		cfg.Body, bodyContentType, err = multipartBody(formFields, multipartFiles)
+		if err != nil {
+			fmt.Println("Error building the multipart body:", err)
+			os.Exit(1)
+		}
+	case len(formFields) > 0:
+		cfg.Body, err = formBody(formFields)
+		if err != nil {
+			fmt.Println("Invalid -form:", err)
+			os.Exit(1)
+		}
+		bodyContentType = "application/x-www-form-urlencoded"
+	default:
+		cfg.Body = []byte(requestBody)
+	}
+
+	switch {
+	case *veryVerbose:
+		cfg.Verbosity = 2
+	case *verbose:
+		cfg.Verbosity = 1
+	}
+
+	if *userAgent != "" && *userAgentsFile != "" {
+		fmt.Println("Only one of -user-agent and -user-agents-file can be given")
+		os.Exit(1)
+	}
+	if *userAgent != "" {
+		cfg.UserAgents = []string{*userAgent}
+	}
+	if *userAgentsFile != "" {
+		cfg.UserAgents, err = loadUserAgents(*userAgentsFile)
+		if err != nil {
+			fmt.Println("Error loading user agents file:", err)
+			os.Exit(1)
+		}
+	}
+
+	// NO_COLOR counts when it is set to anything but an empty string, see
+	// https://no-color.org
+	cfg.color = !*noColor && os.Getenv("NO_COLOR") == "" && cfg.outputFormat == "text" && isTerminal(os.Stdout)
+
+	if cfg.repeat <= 0 {
+		fmt.Printf("Invalid repeat: %d (must be a positive integer)\n", cfg.repeat)
+		os.Exit(1)
+	}
+	if cfg.repeat > 1 && cfg.outputFormat == "prom" {
+		fmt.Println("-repeat cannot be combined with -output prom, every run would repeat the same metrics")
+		os.Exit(1)
+	}
+
+	if cfg.MaxErrors < 0 {
+		fmt.Printf("Invalid max errors: %d (must be zero or positive)\n", cfg.MaxErrors)
+		os.Exit(1)
+	}
+	if cfg.DrainTimeout < 0 {
+		fmt.Printf("Invalid drain timeout: %s (must be zero or positive)\n", cfg.DrainTimeout)
+		os.Exit(1)
+	}
+	if cfg.MaxDuration < 0 {
+		fmt.Printf("Invalid max duration: %s (must be zero or positive)\n", cfg.MaxDuration)
+		os.Exit(1)
+	}
+	if cfg.MaxErrorRate < 0 || cfg.MaxErrorRate > 100 {
+		fmt.Printf("Invalid max error rate: %g (must be between 0 and 100)\n", cfg.MaxErrorRate)
+		os.Exit(1)
+	}
+
+	if *baselineFile != "" {
+		cfg.baseline, err = loadBaseline(*baselineFile)
+		if err != nil {
+			fmt.Println("Invalid -baseline:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.regressionThreshold < 0 {
+		fmt.Printf("Invalid regression threshold: %g (must be zero or positive)\n", cfg.regressionThreshold)
+		os.Exit(1)
+	}
+
+	if cfg.reportDir != "" {
+		if err := checkWritableDir(cfg.reportDir); err != nil {
+			fmt.Println("Invalid -report-dir:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.SaveFailures != "" {
+		if cfg.SaveLimit <= 0 {
+			fmt.Printf("Invalid save limit: %d (must be a positive integer)\n", cfg.SaveLimit)
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(cfg.SaveFailures, 0o755); err != nil {
+			fmt.Println("Error creating -save-failures directory:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dataFile != "" {
+		cfg.data, err = loadDataSet(*dataFile)
+		if err != nil {
+			fmt.Println("Error loading data file:", err)
+			os.Exit(1)
+		}
+	}
+
+	hasBody := len(cfg.Body) > 0 || len(cfg.Bodies) > 0
+	if hasBody && !methodAllowsBody(cfg.Method) && *scenarioFile == "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s requests are sent without a body, ignoring -body\n", cfg.Method)
+	}
+	if !hasBody && methodExpectsBody(cfg.Method) && !*allowEmptyBody && *scenarioFile == "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s requests are sent with an empty body, give one with -body or -body-file (-allow-empty-body silences this)\n", cfg.Method)
+	}
+
+	if cfg.Chunked && !hasBody && *scenarioFile == "" {
+		fmt.Fprintln(os.Stderr, "Warning: -chunked has no effect, requests without a body are not chunked")
+	}
+
+	if cfg.PerHostRate < 0 {
+		fmt.Printf("Invalid per-host-rate: %g (must be zero or positive)\n", cfg.PerHostRate)
+		os.Exit(1)
+	}
+
+	if cfg.Warmup < 0 {
+		fmt.Printf("Invalid warmup: %d (must be zero or positive)\n", cfg.Warmup)
+		os.Exit(1)
+	}
+
+	if cfg.PrewarmConns < 0 {
+		fmt.Printf("Invalid prewarm connections: %d (must be zero or positive)\n", cfg.PrewarmConns)
+		os.Exit(1)
+	}
+	idlePerHost := cfg.MaxIdleConnsPerHost
+	if idlePerHost == 0 {
+		idlePerHost = cfg.Concurrency
+	}
+	switch {
+	case cfg.PrewarmConns > 0 && cfg.DisableKeepAlive:
+		fmt.Fprintln(os.Stderr, "Warning: -prewarm-conns has no effect with -disable-keepalive")
+		cfg.PrewarmConns = 0
+	case cfg.PrewarmConns > idlePerHost:
+		fmt.Fprintf(os.Stderr, "Warning: only %d of -prewarm-conns %d stay open, the pool keeps that many idle connections per host\n", idlePerHost, cfg.PrewarmConns)
+	}
+
+	if *sloSpec != "" {
+		cfg.SLOBuckets, err = parseSLOBuckets(*sloSpec)
+		if err != nil {
+			fmt.Println("Invalid -slo-buckets:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Bootstrap < 0 {
+		fmt.Printf("Invalid bootstrap resamples: %d (must be zero or positive)\n", cfg.Bootstrap)
+		os.Exit(1)
+	}
+
+	if cfg.HistBuckets < 0 {
+		fmt.Printf("Invalid histogram buckets: %d (must be zero or positive)\n", cfg.HistBuckets)
+		os.Exit(1)
+	}
+
+	if cfg.RampUp < 0 {
+		fmt.Printf("Invalid ramp-up: %s (must be zero or positive)\n", cfg.RampUp)
+		os.Exit(1)
+	}
+
+	if cfg.StartJitter < 0 {
+		fmt.Printf("Invalid start jitter: %s (must be zero or positive)\n", cfg.StartJitter)
+		os.Exit(1)
+	}
+
+	if *thinkTimeSpec != "" {
+		cfg.ThinkTimeMin, cfg.ThinkTimeMax, err = parseThinkTime(*thinkTimeSpec)
+		if err != nil {
+			fmt.Println("Invalid -think-time:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Timeout <= 0 {
+		fmt.Printf("Invalid timeout: %s (must be positive)\n", cfg.Timeout)
+		os.Exit(1)
+	}
+	if cfg.BodyReadTimeout < 0 {
+		fmt.Printf("Invalid body read timeout: %s (must be zero or positive)\n", cfg.BodyReadTimeout)
+		os.Exit(1)
+	}
+	if cfg.SSE {
+		if cfg.SSEDuration <= 0 {
+			fmt.Printf("Invalid SSE duration: %s (must be positive)\n", cfg.SSEDuration)
+			os.Exit(1)
+		}
+		if cfg.BodyReadTimeout > 0 {
+			fmt.Fprintln(os.Stderr, "Warning: -body-read-timeout has no effect with -sse, streams are kept open for -sse-duration")
+		}
+	}
+
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 || cfg.IdleConnTimeout < 0 {
+		fmt.Println("Invalid connection pool settings: -max-idle-conns, -max-idle-conns-per-host and -idle-conn-timeout must be zero or positive")
+		os.Exit(1)
+	}
+	if cfg.DisableKeepAlive {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "max-idle-conns", "max-idle-conns-per-host", "idle-conn-timeout":
+				fmt.Fprintf(os.Stderr, "Warning: -%s has no effect with -disable-keepalive\n", f.Name)
+			}
+		})
+	}
+
+	if *proxy != "" {
+		cfg.ProxyURL, err = url.Parse(*proxy)
+		if err != nil || cfg.ProxyURL.Host == "" {
+			fmt.Println("Invalid -proxy:", *proxy)
+			os.Exit(1)
+		}
+		switch cfg.ProxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			fmt.Printf("Invalid -proxy: unsupported scheme %q (must be http, https or socks5)\n", cfg.ProxyURL.Scheme)
+			os.Exit(1)
+		}
+	}
+
+	if *caCert != "" {
+		pem, err := os.ReadFile(*caCert)
+		if err != nil {
+			fmt.Println("Error reading -cacert:", err)
+			os.Exit(1)
+		}
+		cfg.TLSConfig.RootCAs = x509.NewCertPool()
+		if !cfg.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			fmt.Println("Invalid -cacert: no PEM certificates found in", *caCert)
+			os.Exit(1)
+		}
+	}
+
+	if (*clientCert == "") != (*clientKey == "") {
+		fmt.Println("-client-cert and -client-key must be given together")
+		os.Exit(1)
+	}
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			fmt.Println("Invalid -client-cert or -client-key:", err)
+			os.Exit(1)
+		}
+		cfg.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if *minTLS != "" {
+		cfg.TLSConfig.MinVersion, err = parseTLSVersion(*minTLS)
+		if err != nil {
+			fmt.Println("Invalid -min-tls:", err)
+			os.Exit(1)
+		}
+	}
+	if *maxTLS != "" {
+		cfg.TLSConfig.MaxVersion, err = parseTLSVersion(*maxTLS)
+		if err != nil {
+			fmt.Println("Invalid -max-tls:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.TLSConfig.MaxVersion != 0 && cfg.TLSConfig.MinVersion > cfg.TLSConfig.MaxVersion {
+		fmt.Println("Invalid TLS versions: -min-tls is above -max-tls")
+		os.Exit(1)
+	}
+
+	if cfg.TLSConfig.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "Warning: TLS certificate verification is disabled (-insecure)")
+	}
+
+	if len(resolve) > 0 {
+		cfg.Resolve, err = parseResolve(resolve)
+		if err != nil {
+			fmt.Println("Invalid -resolve:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *localAddr != "" {
+		cfg.LocalAddrs, err = parseLocalAddrs(*localAddr)
+		if err != nil {
+			fmt.Println("Invalid -local-addr:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.UnixSocket != "" {
+		if len(resolve) > 0 || *localAddr != "" || *proxy != "" {
+			fmt.Println("-unix-socket cannot be combined with -resolve, -local-addr or -proxy, every connection goes to the socket")
+			os.Exit(1)
+		}
+		if info, err := os.Stat(cfg.UnixSocket); err != nil || info.Mode()&os.ModeSocket == 0 {
+			fmt.Println("Invalid -unix-socket:", cfg.UnixSocket, "is not a socket")
+			os.Exit(1)
+		}
+	}
+
+	if cfg.MaxRedirects < 0 {
+		fmt.Printf("Invalid max redirects: %d (must be zero or positive)\n", cfg.MaxRedirects)
+		os.Exit(1)
+	}
+
+	if cfg.Sitemap != "" && cfg.SitemapLimit <= 0 {
+		fmt.Printf("Invalid sitemap limit: %d (must be a positive integer)\n", cfg.SitemapLimit)
+		os.Exit(1)
+	}
+
+	for _, value := range seedCookies {
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Printf("Invalid -cookie %q: must be in the form name=value\n", value)
+			os.Exit(1)
+		}
+		cfg.Cookies = append(cfg.Cookies, &http.Cookie{Name: strings.TrimSpace(name), Value: strings.TrimSpace(val)})
+	}
+	if cfg.MaxRetries < 0 {
+		fmt.Printf("Invalid retries: %d (must be zero or positive)\n", cfg.MaxRetries)
+		os.Exit(1)
+	}
+
+	if cfg.RetryBackoff < 0 {
+		fmt.Printf("Invalid retry backoff: %s (must be zero or positive)\n", cfg.RetryBackoff)
+		os.Exit(1)
+	}
+	if *retryPolicy != "" {
+		cfg.RetryPolicies, err = parseRetryPolicies(*retryPolicy)
+		if err != nil {
+			fmt.Println("Invalid -retry-policy:", err)
+			os.Exit(1)
+		}
+		if cfg.RetryBackoff == 0 {
+			fmt.Fprintln(os.Stderr, "Warning: -retry-policy retries right away without a Retry-After, -retry-backoff is 0")
+		}
+	}
+
+	if *basicAuth != "" && cfg.BearerToken != "" {
+		fmt.Println("Only one of -basic-auth and -bearer can be given")
+		os.Exit(1)
+	}
+
+	if *basicAuth != "" {
+		var ok bool
+		cfg.BasicAuthUser, cfg.BasicAuthPassword, ok = strings.Cut(*basicAuth, ":")
+		if !ok || cfg.BasicAuthUser == "" {
+			fmt.Println("Invalid -basic-auth: must be in the form user:password")
+			os.Exit(1)
+		}
+	}
+
+	if cfg.HMACHash = hmacHashes[strings.ToLower(*hmacAlgo)]; cfg.HMACHash == nil {
+		fmt.Printf("Invalid HMAC algorithm: %s (must be sha1, sha256 or sha512)\n", *hmacAlgo)
+		os.Exit(1)
+	}
+	if cfg.HMACSecret != "" && cfg.HMACHeader == "" {
+		fmt.Println("Invalid -hmac-header: it cannot be empty with -hmac-secret")
+		os.Exit(1)
+	}
+
+	if headersFile != "" {
+		headers, err := loadHeaders(headersFile)
+		if err != nil {
+			fmt.Println("Error loading headers:", err)
+			os.Exit(1)
+		}
+		for key, value := range headers {
+			cfg.Headers[key] = value
+		}
+	}
+
+	// Headers given on the command line win over the file
+	for key, value := range extraHeaders {
+		cfg.Headers[key] = value
+	}
+
+	// The body of -form and -multipart-file only makes sense with its own
+	// Content-Type, a multipart one carries the boundary
+	if bodyContentType != "" {
+		mediaType, _, _ := strings.Cut(bodyContentType, ";")
+		for key := range cfg.Headers {
+			if strings.EqualFold(key, "Content-Type") {
+				fmt.Fprintf(os.Stderr, "Warning: ignoring the %s header, -form and -multipart-file send %s\n", key, mediaType)
+				delete(cfg.Headers, key)
+			}
+		}
+		cfg.Headers["Content-Type"] = bodyContentType
+	}
+
+	return cfg
+}
+
+// runRequests sends requests with -c workers until count requests have been
+// dispatched, or until ctx is done when timed is set, and returns what every
+// worker recorded
+func (r *Runner) runRequests(ctx context.Context, count int, timed bool, ramp, jitter time.Duration) []*workerStats {
+	jobs := make(chan int)
+
+	workers := r.cfg.Concurrency
+	if !timed {
+		workers = min(r.cfg.Concurrency, count)
+	}
+	allStats := make([]*workerStats, workers)
+	r.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		allStats[i] = r.newWorkerStats()
+		// Spread the workers evenly over the ramp-up window, each one a
+		// random bit later with jitter
+		delay := ramp * time.Duration(i) / time.Duration(workers)
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		go r.worker(ctx, jobs, allStats[i], delay)
+	}
+
+	// In duration mode keep handing out work until the context expires,
+	// otherwise stop once count requests have been dispatched
+dispatch:
+	for i := 0; timed || i < count; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+
+	// Requests still in flight after -drain-timeout are canceled, so that a
+	// hung one cannot stall the end of the run
+	if r.cfg.DrainTimeout > 0 {
+		drainTimer := time.AfterFunc(r.cfg.DrainTimeout, r.cancelRequests)
+		defer drainTimer.Stop()
+	}
+	r.wg.Wait()
+
+	return allStats
+}
+
+// prewarm opens -prewarm-conns connections to every host with HEAD requests
+// sent all at once, so that each of them needs a connection of its own. They
+// go around the rate limiters and nothing about them is recorded, except in
+// r.prewarmed how many new connections came back.
+func (r *Runner) prewarm(ctx context.Context) {
+	// Redirects would be followed on connections to other hosts
+	client := *r.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var opened atomic.Int64
+	var wg sync.WaitGroup
+	seen := make(map[*hostLimit]bool)
+	for _, t := range r.targets {
+		if seen[t.limit] {
+			continue
+		}
+		seen[t.limit] = true
+
+		for i := 0; i < r.cfg.PrewarmConns; i++ {
+			wg.Add(1)
+			go func(rawURL string) {
+				defer wg.Done()
+				var fresh bool
+				trace := &httptrace.ClientTrace{
+					GotConn: func(info httptrace.GotConnInfo) { fresh = !info.Reused },
+				}
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, rawURL, nil)
+				if err != nil {
+					return
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return
+				}
+				resp.Body.Close()
+				if fresh {
+					opened.Add(1)
+				}
+			}(t.URL)
+		}
+	}
+	wg.Wait()
+
+	r.prewarmed = int(opened.Load())
+}
+
+// resetCounters forgets everything recorded so far, used once the warmup is over
+func (r *Runner) resetCounters() {
+	r.requestCount.Store(0)
+	r.successCount.Store(0)
+	r.failureCount.Store(0)
+	r.transportErrorCount.Store(0)
+	r.httpErrorCount.Store(0)
+	r.retriedCount.Store(0)
+	r.bodyFailureCount.Store(0)
+	r.headerFailureCount.Store(0)
+	r.abortedCount.Store(0)
+	r.redirectCount.Store(0)
+	for _, h := range r.hostLimits {
+		h.requests.Store(0)
+		h.inFlight.peak.Store(0)
+	}
+	r.inFlight.peak.Store(0)
+	r.consecutiveFailures.Store(0)
+	r.abortReason.Store(nil)
+	r.interrupted.Store(false)
+	r.reusedConns.Store(0)
+	r.newConns.Store(0)
+
+	// What the previous run of -repeat merged. Its Results still hold the
+	// maps, so they are replaced rather than cleared.
+	r.responseTimes = nil
+	r.statusCodes = make(map[int]int)
+	r.protocols = make(map[string]int)
+	r.tlsVersions = make(map[string]int)
+	r.tlsCiphers = make(map[string]int)
+	r.servers = make(map[string]int)
+	r.errorCounts = make(map[string]int)
+	r.phases = phaseTimes{}
+	r.throughput = nil
+	r.selfStats = SelfStats{}
+	r.bodySizes = bodySizes{}
+	r.streamEvents = nil
+	r.eventGaps = nil
+}
+
+// ThroughputLevel is what one concurrency level of -find-max-throughput
+// achieved
+type ThroughputLevel struct {
+	Concurrency int     `json:"concurrency"`
+	RequestRate float64 `json:"request_rate"`
+	ErrorRate   float64 `json:"error_rate"`
+	Latency     Latency `json:"latency"`
+}
+
+// plateauGain is the percentage a concurrency level has to add to the best
+// throughput so far for -find-max-throughput to keep going
+const plateauGain = 5
+
+// findMaxThroughput runs the test at -concurrency-step, twice that and so on
+// up to -c, each level for -d, until the throughput stops growing by
+// plateauGain or the error rate goes above -knee-error-rate. The knee is the
+// level with the highest throughput before that.
+func (r *Runner) findMaxThroughput(ctx context.Context) {
+	maxConcurrency := r.cfg.Concurrency
+	defer func() { r.cfg.Concurrency = maxConcurrency }()
+
+	var levels []ThroughputLevel
+	knee := -1
+	var stopped string
+	for concurrency := r.cfg.concurrencyStep; ; concurrency += r.cfg.concurrencyStep {
+		concurrency = min(concurrency, maxConcurrency)
+		r.cfg.Concurrency = concurrency
+		results := r.Run(ctx)
+
+		level := ThroughputLevel{Concurrency: concurrency, RequestRate: results.RequestRate, Latency: results.Latency}
+		if results.Total > 0 {
+			level.ErrorRate = float64(results.Failure) / float64(results.Total) * 100
+		}
+		levels = append(levels, level)
+		fmt.Fprintf(os.Stderr, "-c %d: %.2f requests/second, %.2f%% errors\n", level.Concurrency, level.RequestRate, level.ErrorRate)
+
+		if results.Interrupted || results.Aborted != "" {
+			stopped = "the run was stopped"
+			break
+		}
+		if level.ErrorRate > r.cfg.kneeErrorRate {
+			stopped = fmt.Sprintf("the error rate went above %g%% (-knee-error-rate)", r.cfg.kneeErrorRate)
+			break
+		}
+		if knee >= 0 && level.RequestRate < levels[knee].RequestRate*(1+plateauGain/100.0) {
+			if level.RequestRate > levels[knee].RequestRate {
+				knee = len(levels) - 1
+			}
+			stopped = fmt.Sprintf("the throughput grew by less than %d%%", plateauGain)
+			break
+		}
+		knee = len(levels) - 1
+		if concurrency == maxConcurrency {
+			stopped = fmt.Sprintf("-c %d was reached, raise it to search further", maxConcurrency)
+			break
+		}
+	}
+
+	if r.cfg.outputFormat == "json" {
+		search := struct {
+			Levels  []ThroughputLevel `json:"levels"`
+			Knee    *ThroughputLevel  `json:"knee,omitempty"`
+			Stopped string            `json:"stopped"`
+		}{Levels: levels, Stopped: stopped}
+		if knee >= 0 {
+			search.Knee = &levels[knee]
+		}
+		printJSON(search)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "Concurrency\tRequests/second\tError rate\tAverage\t99th percentile\t")
+	for i, level := range levels {
+		mark := ""
+		if i == knee {
+			mark = "knee"
+		}
+		fmt.Fprintf(w, "%d\t%.2f\t%.2f%%\t%s\t%s\t%s\n", level.Concurrency, level.RequestRate, level.ErrorRate,
+			formatDuration(level.Latency.Average), formatDuration(level.Latency.P99), mark)
+	}
+	w.Flush()
+	fmt.Println()
+	fmt.Printf("Stopped because %s\n", stopped)
+	if knee < 0 {
+		fmt.Println("No concurrency level stayed within -knee-error-rate")
+		return
+	}
+	fmt.Printf("Max throughput: %.2f requests/second at -c %d\n", levels[knee].RequestRate, levels[knee].Concurrency)
+}
+
+// handleInterrupt stops the run on the first Ctrl-C so that in-flight
+// requests can finish and the partial summary is printed. A second Ctrl-C
+// exits immediately.
+func (r *Runner) handleInterrupt(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nInterrupted, waiting for in-flight requests (press Ctrl-C again to quit now)")
+		cancel()
+
+		<-signals
+		os.Exit(130)
+	}()
+}
+
+// startPprof serves the net/http/pprof handlers on addr for the length of
+// the run. They are registered on their own mux rather than the default one.
+func startPprof(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	fmt.Fprintf(os.Stderr, "Serving pprof on http://%s/debug/pprof/\n", listener.Addr())
+
+	return server, nil
+}
+
+// stopPprof gives profiles that are still being downloaded a moment to finish
+func stopPprof(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// Main is the command line tool: it runs the test the flags describe, prints
+// the summary and exits with code 1 when a threshold failed
+func Main() {
+	cfg := parseFlags()
+
+	runner, err := NewRunner(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if runner.sitemapErr != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not load -sitemap:", runner.sitemapErr)
+	}
+
+	if cfg.dryRun {
+		runner.printDryRun()
+		return
+	}
+
+	outputs, err := openRecorders(cfg)
+	if err != nil {
+		fmt.Println("Error", err)
+		os.Exit(1)
+	}
+
+	if cfg.pprofAddr != "" {
+		server, err := startPprof(cfg.pprofAddr)
+		if err != nil {
+			fmt.Println("Error starting -pprof:", err)
+			os.Exit(1)
+		}
+		defer stopPprof(server)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner.handleInterrupt(cancel)
+
+	// Warmup requests only prime connections and caches, nothing they
+	// record is kept and they are not written to the CSV or JSON lines file
+	if cfg.Warmup > 0 {
+		fmt.Fprintf(os.Stderr, "Warming up with %d requests\n", cfg.Warmup)
+		runner.runRequests(ctx, cfg.Warmup, false, 0, 0)
+		runner.resetCounters()
+	}
+	if cfg.PrewarmConns > 0 {
+		runner.prewarm(ctx)
+		fmt.Fprintf(os.Stderr, "Pre-warmed %d of %d connections\n", runner.prewarmed, cfg.PrewarmConns*len(runner.hostLimits))
+	}
+	runner.recorders = outputs
+
+	if cfg.findMaxThroughput {
+		runner.findMaxThroughput(ctx)
+		for _, r := range runner.recorders {
+			if err := r.close(); err != nil {
+				fmt.Println("Error writing request records:", err)
+			}
+		}
+		return
+	}
+
+	var runs []Results
+	for i := 0; i < cfg.repeat; i++ {
+		if cfg.repeat > 1 {
+			fmt.Fprintf(os.Stderr, "Run %d of %d\n", i+1, cfg.repeat)
+		}
+		results := runner.Run(ctx)
+		runs = append(runs, results)
+		if i > 0 && cfg.outputFormat == "text" {
+			fmt.Println()
+		}
+		if cfg.outputFormat != "json" || cfg.repeat == 1 {
+			runner.printResults(results)
+		}
+		// A Ctrl-C or -max-errors ends the remaining runs as well
+		if results.Interrupted || results.Aborted != "" {
+			break
+		}
+	}
+
+	for _, r := range runner.recorders {
+		if err := r.close(); err != nil {
+			fmt.Println("Error writing request records:", err)
+		}
+	}
+
+	if cfg.repeat > 1 {
+		summary := summarizeRuns(runs)
+		if cfg.outputFormat == "json" {
+			printJSON(repeatResults{runs, summary})
+		} else {
+			printRepeatSummary(summary)
+		}
+	}
+
+	if cfg.reportDir != "" {
+		if err := writeReport(cfg.reportDir, runs, redactURL(cfg.targetArg)); err != nil {
+			fmt.Println("Error writing -report-dir:", err)
+			os.Exit(1)
+		}
+	}
+
+	var breaches []string
+	for i, results := range runs {
+		for _, breach := range runner.checkThresholds(results) {
+			if cfg.repeat > 1 {
+				breach = fmt.Sprintf("run %d: %s", i+1, breach)
+			}
+			breaches = append(breaches, breach)
+		}
+	}
+	if len(breaches) > 0 {
+		for _, breach := range breaches {
+			fmt.Fprintln(os.Stderr, "Threshold failed:", breach)
+		}
+		os.Exit(1)
+	}
+
+	// A run without a single success, e.g. against a server that is down,
+	// fails whatever the thresholds
+	for _, results := range runs {
+		if results.Success == 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// Run sends the requests of cfg and returns what they recorded, the way a
+// single run of the command line does. Canceling ctx stops sending requests,
+// the results then cover what was sent so far.
+func Run(ctx context.Context, cfg Config) (Results, error) {
+	runner, err := NewRunner(&cfg)
+	if err != nil {
+		return Results{}, err
+	}
+	// Every Run has a transport of its own, its connections would outlive it
+	defer runner.client.CloseIdleConnections()
+
+	if cfg.Warmup > 0 {
+		runner.runRequests(ctx, cfg.Warmup, false, 0, 0)
+	}
+	if cfg.PrewarmConns > 0 {
+		runner.prewarm(ctx)
+	}
+
+	runner.recorders, err = openRecorders(&cfg)
+	if err != nil {
+		return Results{}, err
+	}
+	results := runner.Run(ctx)
+	for _, rec := range runner.recorders {
+		if closeErr := rec.close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("writing request records: %w", closeErr)
+		}
+	}
+
+	return results, err
+}
+
+// setStep switches the rate limiter to step i of -load-profile
+func (r *Runner) setStep(i int) {
+	r.step.Store(int64(i))
+	r.limiter.SetLimit(rate.Limit(r.cfg.LoadProfile[i].Rate))
+}
+
+// followLoadProfile moves on to the next step of -load-profile whenever the
+// current one is over, until the last one or the run ends
+func (r *Runner) followLoadProfile(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	for i, step := range r.cfg.LoadProfile {
+		if i > 0 {
+			r.setStep(i)
+		}
+		if i == len(r.cfg.LoadProfile)-1 {
+			return
+		}
+		select {
+		case <-time.After(step.Duration):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run sends the requests of a single run and returns what they recorded.
+// Everything a previous run recorded is reset first.
+func (r *Runner) Run(ctx context.Context) Results {
+	r.resetCounters()
+
+	caller := ctx
+	// -max-errors, -max-error-rate and -max-duration stop this run only,
+	// not the ctx of the caller that may still run others
+	ctx, r.stopRun = context.WithCancel(ctx)
+	defer r.stopRun()
+
+	if r.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Duration)
+		defer cancel()
+	}
+
+	// The requests of the previous run of -repeat may have been canceled
+	r.requestsCtx, r.cancelRequests = context.WithCancel(context.Background())
+	defer r.cancelRequests()
+
+	// Unlike -d, -max-duration does not wait for the requests in flight
+	if r.cfg.MaxDuration > 0 {
+		capTimer := time.AfterFunc(r.cfg.MaxDuration, func() {
+			r.abortRun(fmt.Sprintf("the -max-duration of %s", r.cfg.MaxDuration))
+			r.cancelRequests()
+		})
+		defer capTimer.Stop()
+	}
+
+	start := time.Now()
+
+	progressCtx, stopProgress := context.WithCancel(context.Background())
+	progressDone := make(chan struct{})
+	// The progress line would be torn apart by verbose log lines on stderr
+	if !r.cfg.Quiet && r.cfg.Verbosity == 0 && isTerminal(os.Stdout) {
+		go r.reportProgress(progressCtx, start, progressDone)
+	} else {
+		close(progressDone)
+	}
+	throughputDone := make(chan struct{})
+	if r.cfg.QPSReport > 0 {
+		go r.sampleThroughput(progressCtx, start, throughputDone)
+	} else {
+		close(throughputDone)
+	}
+
+	selfStatsDone := make(chan struct{})
+	if r.cfg.SelfStats {
+		go r.sampleSelf(progressCtx, selfStatsDone)
+	} else {
+		close(selfStatsDone)
+	}
+
+	profileDone := make(chan struct{})
+	if len(r.cfg.LoadProfile) > 0 {
+		r.setStep(0)
+		go r.followLoadProfile(ctx, profileDone)
+	} else {
+		close(profileDone)
+	}
+
+	allStats := r.runRequests(ctx, r.cfg.TotalRequests, r.cfg.Duration > 0, r.cfg.RampUp, r.cfg.StartJitter)
+	// Canceling the ctx of the caller is what Ctrl-C does on the command line
+	if caller.Err() != nil {
+		r.interrupted.Store(true)
+	}
+
+	totalElapsed := time.Since(start)
+	stopProgress()
+	<-progressDone
+	<-throughputDone
+	<-selfStatsDone
+	<-profileDone
+
+	r.mergeWorkerStats(allStats)
+
+	return r.buildResults(totalElapsed)
+}
+
+func (r *Runner) printResults(results Results) {
+	switch r.cfg.outputFormat {
+	case "json":
+		printJSON(results)
+	case "prom":
+		printPrometheus(results)
+	default:
+		r.printText(results)
+	}
+}
+
+// repeatResults is the JSON output of -repeat
+type repeatResults struct {
+	Runs    []Results     `json:"runs"`
+	Summary RepeatSummary `json:"summary"`
+}
+
+// RepeatSummary is the spread of the main metrics across the runs of -repeat
+type RepeatSummary struct {
+	Runs        int           `json:"runs"`
+	SuccessRate ValueRange    `json:"success_rate"`
+	RequestRate ValueRange    `json:"request_rate"`
+	Average     DurationRange `json:"avg"`
+	P50         DurationRange `json:"p50"`
+	P90         DurationRange `json:"p90"`
+	P95         DurationRange `json:"p95"`
+	P99         DurationRange `json:"p99"`
+}
+
+// ValueRange is the mean, lowest and highest value of a metric across runs
+type ValueRange struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// DurationRange is a ValueRange of a duration
+type DurationRange struct {
+	Mean time.Duration `json:"mean_ns"`
+	Min  time.Duration `json:"min_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+func summarizeRuns(runs []Results) RepeatSummary {
+	values := func(value func(Results) float64) ValueRange {
+		v := ValueRange{Min: math.Inf(1), Max: math.Inf(-1)}
+		for _, results := range runs {
+			x := value(results)
+			v.Mean += x / float64(len(runs))
+			v.Min = math.Min(v.Min, x)
+			v.Max = math.Max(v.Max, x)
+		}
+		return v
+	}
+	durations := func(value func(Results) time.Duration) DurationRange {
+		v := values(func(results Results) float64 { return float64(value(results)) })
+		return DurationRange{Mean: time.Duration(v.Mean), Min: time.Duration(v.Min), Max: time.Duration(v.Max)}
+	}
+
+	return RepeatSummary{
+		Runs:        len(runs),
+		SuccessRate: values(func(r Results) float64 { return r.SuccessRate }),
+		RequestRate: values(func(r Results) float64 { return r.RequestRate }),
+		Average:     durations(func(r Results) time.Duration { return r.Latency.Average }),
+		P50:         durations(func(r Results) time.Duration { return r.Latency.P50 }),
+		P90:         durations(func(r Results) time.Duration { return r.Latency.P90 }),
+		P95:         durations(func(r Results) time.Duration { return r.Latency.P95 }),
+		P99:         durations(func(r Results) time.Duration { return r.Latency.P99 }),
+	}
+}
+
+func printRepeatSummary(summary RepeatSummary) {
+	fmt.Printf("\nAcross %d runs\n", summary.Runs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "Metric\tMean\tMin\tMax")
+	fmt.Fprintf(w, "Success rate\t%.2f%%\t%.2f%%\t%.2f%%\n", summary.SuccessRate.Mean, summary.SuccessRate.Min, summary.SuccessRate.Max)
+	fmt.Fprintf(w, "Request rate\t%.2f/s\t%.2f/s\t%.2f/s\n", summary.RequestRate.Mean, summary.RequestRate.Min, summary.RequestRate.Max)
+	for _, row := range []struct {
+		name  string
+		value DurationRange
+	}{
+		{"Average response time", summary.Average},
+		{"50th percentile response time", summary.P50},
+		{"90th percentile response time", summary.P90},
+		{"95th percentile response time", summary.P95},
+		{"99th percentile response time", summary.P99},
+	} {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.name, formatDuration(row.value.Mean), formatDuration(row.value.Min), formatDuration(row.value.Max))
+	}
+	w.Flush()
+}
+
+// checkThresholds returns a description of every -fail-if-* threshold the
+// results violate
+func (r *Runner) checkThresholds(results Results) []string {
+	var breaches []string
+
+	if r.cfg.failIfSuccessRateBelow > 0 && results.SuccessRate < r.cfg.failIfSuccessRateBelow {
+		breaches = append(breaches, fmt.Sprintf("success rate %.2f%% is below %.2f%%", results.SuccessRate, r.cfg.failIfSuccessRateBelow))
+	}
+	if r.cfg.failIfP99Above > 0 && results.Latency.P99 > r.cfg.failIfP99Above {
+		breaches = append(breaches, fmt.Sprintf("99th percentile response time %s is above %s", results.Latency.P99, r.cfg.failIfP99Above))
+	}
+	if r.cfg.baseline != nil {
+		for _, delta := range compareBaseline(*r.cfg.baseline, results, r.cfg.regressionThreshold) {
+			if delta.regressed {
+				breaches = append(breaches, fmt.Sprintf("%s regressed from %s to %s (%s) against the baseline", strings.ToLower(delta.metric), delta.baseline, delta.current, delta.change))
+			}
+		}
+	}
+
+	return breaches
+}
+
+// baselineDelta is how a metric of a run changed against -baseline
+type baselineDelta struct {
+	metric    string
+	baseline  string
+	current   string
+	change    string
+	regressed bool
+}
+
+// compareBaseline compares the percentiles and the success rate of results
+// with those of baseline. A percentile regressed when it grew by more than
+// threshold percent, the success rate when it dropped by more than threshold
+// percentage points.
+func compareBaseline(baseline, results Results, threshold float64) []baselineDelta {
+	percentiles := []struct {
+		metric            string
+		baseline, current time.Duration
+	}{
+		{"50th percentile", baseline.Latency.P50, results.Latency.P50},
+		{"95th percentile", baseline.Latency.P95, results.Latency.P95},
+		{"99th percentile", baseline.Latency.P99, results.Latency.P99},
+	}
+
+	var deltas []baselineDelta
+	for _, p := range percentiles {
+		delta := baselineDelta{metric: p.metric, baseline: formatDuration(p.baseline), current: formatDuration(p.current), change: "-"}
+		if p.baseline > 0 {
+			change := float64(p.current-p.baseline) / float64(p.baseline) * 100
+			delta.change = fmt.Sprintf("%+.1f%%", change)
+			delta.regressed = change > threshold
+		}
+		deltas = append(deltas, delta)
+	}
+
+	change := results.SuccessRate - baseline.SuccessRate
+	deltas = append(deltas, baselineDelta{
+		metric:    "Success rate",
+		baseline:  fmt.Sprintf("%.2f%%", baseline.SuccessRate),
+		current:   fmt.Sprintf("%.2f%%", results.SuccessRate),
+		change:    fmt.Sprintf("%+.2f points", change),
+		regressed: -change > threshold,
+	})
+	return deltas
+}
+
+// loadBaseline reads the -output json results of an earlier run
+func loadBaseline(path string) (*Results, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var baseline struct {
+		Results
+		Runs []Results `json:"runs"`
+	}
+	if err := json.Unmarshal(content, &baseline); err != nil {
+		return nil, err
+	}
+	if len(baseline.Runs) > 0 {
+		return nil, errors.New("it holds the runs of -repeat, pass the results of a single run")
+	}
+	if baseline.Total == 0 {
+		return nil, errors.New("it has no requests, it must be the -output json results of a run")
+	}
+	return &baseline.Results, nil
+}
+
+// Results is the summary of a run. Its JSON encoding is the machine readable
+// output of -output json, so fields should only ever be added, not renamed.
+// Durations are encoded as integer nanoseconds.
+type Results struct {
+	Target            string             `json:"target"`
+	Total             int                `json:"total"`
+	Success           int                `json:"success"`
+	Failure           int                `json:"failure"`
+	TransportErrors   int                `json:"transport_errors"`
+	HTTPErrors        int                `json:"http_errors"`
+	Retried           int                `json:"retried"`
+	AbortedRequests   int                `json:"aborted_requests,omitempty"`
+	BodyFailures      int                `json:"body_failures"`
+	HeaderFailures    int                `json:"header_failures"`
+	RedirectsFollowed int                `json:"redirects_followed"`
+	RedirectResponses int                `json:"redirect_responses"`
+	NotModified       int                `json:"not_modified,omitempty"`
+	NotModifiedRate   float64            `json:"not_modified_rate,omitempty"`
+	SuccessRate       float64            `json:"success_rate"`
+	Duration          time.Duration      `json:"duration_ns"`
+	RequestRate       float64            `json:"request_rate"`
+	RampUp            time.Duration      `json:"ramp_up_ns,omitempty"`
+	Warmup            int                `json:"warmup,omitempty"`
+	PrewarmedConns    int                `json:"prewarmed_connections,omitempty"`
+	Interrupted       bool               `json:"interrupted,omitempty"`
+	Aborted           string             `json:"aborted,omitempty"`
+	Concurrency       int                `json:"concurrency"`
+	PeakConcurrency   int                `json:"peak_concurrency"`
+	ReusedConns       int                `json:"reused_connections"`
+	NewConns          int                `json:"new_connections"`
+	ReuseRatio        float64            `json:"reuse_ratio"`
+	Latency           Latency            `json:"latency"`
+	LatencyCI         *LatencyIntervals  `json:"latency_ci,omitempty"`
+	StatusCodes       map[int]int        `json:"status_codes"`
+	Protocols         map[string]int     `json:"protocols"`
+	TLSVersions       map[string]int     `json:"tls_versions,omitempty"`
+	TLSCiphers        map[string]int     `json:"tls_ciphers,omitempty"`
+	Servers           map[string]int     `json:"servers,omitempty"`
+	Errors            map[string]int     `json:"errors,omitempty"`
+	Endpoints         []EndpointResults  `json:"endpoints,omitempty"`
+	Steps             []StepResults      `json:"steps,omitempty"`
+	Bodies            []BodyResults      `json:"bodies,omitempty"`
+	Phases            *PhaseResults      `json:"phases,omitempty"`
+	Throughput        []ThroughputWindow `json:"throughput,omitempty"`
+	SelfStats         *SelfStats         `json:"self_stats,omitempty"`
+	SSE               *SSEResults        `json:"sse,omitempty"`
+	BodySize          *BodySizeResults   `json:"body_size,omitempty"`
+	Hosts             []HostResults      `json:"hosts,omitempty"`
+	Histogram         []HistogramBucket  `json:"histogram,omitempty"`
+	SLO               []SLOBucket        `json:"slo,omitempty"`
+}
+
+// HistogramBucket counts the response times from From up to To. The last
+// bucket includes To, the slowest response.
+type HistogramBucket struct {
+	From  time.Duration `json:"from_ns"`
+	To    time.Duration `json:"to_ns"`
+	Count int           `json:"count"`
+}
+
+// Interval is a 95% confidence interval of a percentile
+type Interval struct {
+	Low  time.Duration `json:"low_ns"`
+	High time.Duration `json:"high_ns"`
+}
+
+// LatencyIntervals are the confidence intervals of the percentiles of
+// Latency that -bootstrap estimates
+type LatencyIntervals struct {
+	P50 Interval `json:"p50"`
+	P90 Interval `json:"p90"`
+	P95 Interval `json:"p95"`
+	P99 Interval `json:"p99"`
+}
+
+// SLOBucket is how many of the requests took at most Under
+type SLOBucket struct {
+	Under   time.Duration `json:"under_ns"`
+	Count   int           `json:"count"`
+	Percent float64       `json:"percent"`
+}
+
+// HostResults is the load a single host:port received, reported when there
+// is more than one host or -per-host-rate is set
+type HostResults struct {
+	Host         string  `json:"host"`
+	Requests     int     `json:"requests"`
+	RequestRate  float64 `json:"request_rate"`
+	PeakInFlight int     `json:"peak_in_flight"`
+}
+
+// BodySizeResults adds up the response bodies that were read to the end.
+// Wire is what came off the connection, Decoded what it decompressed to.
+type BodySizeResults struct {
+	Responses      int     `json:"responses"`
+	Wire           int64   `json:"wire_bytes"`
+	Decoded        int64   `json:"decoded_bytes"`
+	AverageWire    float64 `json:"avg_wire_bytes"`
+	AverageDecoded float64 `json:"avg_decoded_bytes"`
+}
+
+// StepResults is what the requests sent during one step of -load-profile
+// recorded
+type StepResults struct {
+	Rate        float64       `json:"target_rate"`
+	Duration    time.Duration `json:"duration_ns"`
+	Total       int           `json:"total"`
+	Failure     int           `json:"failure"`
+	RequestRate float64       `json:"request_rate"`
+	Latency     Latency       `json:"latency"`
+}
+
+// SelfStats is what -self-stats sampled of the load generator itself, to
+// tell whether it rather than the server was the bottleneck
+type SelfStats struct {
+	GOMAXPROCS     int           `json:"gomaxprocs"`
+	PeakGoroutines int           `json:"peak_goroutines"`
+	PeakHeap       uint64        `json:"peak_heap_bytes"`
+	GCCycles       uint32        `json:"gc_cycles"`
+	GCPause        time.Duration `json:"gc_pause_ns"`
+}
 
-	averageResponseTime := totalResponseTime / time.Duration(len(responseTimes))
-	averageRequestRate := float64(totalRequests) / totalElapsed.Seconds()
-	successRate := float64(successCount) / float64(totalRequests) * 100
-	percentile99 := calculatePercentile(responseTimes, 99)
-
-	parsedUrl, err := url.Parse(targetUrl)
-	if err != nil {
-		fmt.Println("Invalid URL")
+// SSEResults is what -sse counted of the event streams, the responses with
+// an expected status. EventGap summarizes the times between two events of
+// the same stream.
+type SSEResults struct {
+	Streams         int     `json:"streams"`
+	Events          int     `json:"events"`
+	EventRate       float64 `json:"event_rate"`
+	EventsPerStream []int   `json:"events_per_stream"`
+	MinEvents       int     `json:"min_events_per_stream"`
+	AverageEvents   float64 `json:"avg_events_per_stream"`
+	MaxEvents       int     `json:"max_events_per_stream"`
+	EventGap        Latency `json:"event_gap"`
+}
+
+// ThroughputWindow is one window of the -qps-report time series. Offset is
+// the start of the window relative to the start of the run.
+type ThroughputWindow struct {
+	Offset      time.Duration `json:"offset_ns"`
+	Requests    int           `json:"requests"`
+	Failures    int           `json:"failures"`
+	RequestRate float64       `json:"request_rate"`
+	ErrorRate   float64       `json:"error_rate"`
+}
+
+// PhaseResults summarizes the connection phases recorded with -trace. Each
+// phase only has samples from the requests that went through it.
+type PhaseResults struct {
+	DNS     Latency `json:"dns"`
+	Connect Latency `json:"connect"`
+	TLS     Latency `json:"tls"`
+	TTFB    Latency `json:"ttfb"`
+}
+
+// EndpointResults is the part of Results recorded for a single URL when more
+// than one URL is under test
+type EndpointResults struct {
+	Name    string  `json:"name,omitempty"`
+	Method  string  `json:"method"`
+	URL     string  `json:"url"`
+	Weight  int     `json:"weight"`
+	Total   int     `json:"total"`
+	Success int     `json:"success"`
+	Failure int     `json:"failure"`
+	Latency Latency `json:"latency"`
+}
+
+// BodyResults is what the requests that sent one of the bodies of -body-dir
+// recorded
+type BodyResults struct {
+	Name    string  `json:"name"`
+	Total   int     `json:"total"`
+	Success int     `json:"success"`
+	Failure int     `json:"failure"`
+	Latency Latency `json:"latency"`
+}
+
+// Latency summarizes the recorded response times
+type Latency struct {
+	Samples int           `json:"samples"`
+	Average time.Duration `json:"avg_ns"`
+	Min     time.Duration `json:"min_ns"`
+	Max     time.Duration `json:"max_ns"`
+	P50     time.Duration `json:"p50_ns"`
+	P90     time.Duration `json:"p90_ns"`
+	P95     time.Duration `json:"p95_ns"`
+	P99     time.Duration `json:"p99_ns"`
+	StdDev  time.Duration `json:"stddev_ns"`
+	CV      float64       `json:"cv"`
+}
+
+func (r *Runner) buildResults(totalElapsed time.Duration) Results {
+	hosts := make([]string, 0, len(r.targets))
+	for _, t := range r.targets {
+		if !slices.Contains(hosts, t.host) {
+			hosts = append(hosts, t.host)
+		}
+	}
+
+	results := Results{
+		Target:          strings.Join(hosts, ", "),
+		Total:           int(r.requestCount.Load()),
+		Success:         int(r.successCount.Load()),
+		Failure:         int(r.failureCount.Load()),
+		TransportErrors: int(r.transportErrorCount.Load()),
+		HTTPErrors:      int(r.httpErrorCount.Load()),
+		Retried:         int(r.retriedCount.Load()),
+		AbortedRequests: int(r.abortedCount.Load()),
+		BodyFailures:    int(r.bodyFailureCount.Load()),
+		HeaderFailures:  int(r.headerFailureCount.Load()),
+		Duration:        totalElapsed,
+		RampUp:          r.cfg.RampUp,
+		Warmup:          r.cfg.Warmup,
+		PrewarmedConns:  r.prewarmed,
+		Interrupted:     r.interrupted.Load(),
+		Concurrency:     r.cfg.Concurrency,
+		PeakConcurrency: int(r.inFlight.peak.Load()),
+		ReusedConns:     int(r.reusedConns.Load()),
+		NewConns:        int(r.newConns.Load()),
+		StatusCodes:     r.statusCodes,
+		Protocols:       r.protocols,
+		TLSVersions:     r.tlsVersions,
+		TLSCiphers:      r.tlsCiphers,
+		Servers:         r.servers,
+		Errors:          r.errorCounts,
+		Throughput:      r.throughput,
+	}
+
+	if conns := results.ReusedConns + results.NewConns; conns > 0 {
+		results.ReuseRatio = float64(results.ReusedConns) / float64(conns)
+	}
+
+	if reason := r.abortReason.Load(); reason != nil {
+		results.Aborted = *reason
+	}
+
+	if r.cfg.SelfStats {
+		selfStats := r.selfStats
+		results.SelfStats = &selfStats
+	}
+
+	if r.cfg.SSE {
+		sse := SSEResults{
+			Streams:         len(r.streamEvents),
+			EventsPerStream: r.streamEvents,
+			EventGap:        summarizeLatency(r.eventGaps),
+		}
+		for _, events := range r.streamEvents {
+			sse.Events += events
+		}
+		if sse.Streams > 0 {
+			sse.MinEvents = slices.Min(r.streamEvents)
+			sse.MaxEvents = slices.Max(r.streamEvents)
+			sse.AverageEvents = float64(sse.Events) / float64(sse.Streams)
+		}
+		sse.EventRate = float64(sse.Events) / totalElapsed.Seconds()
+		results.SSE = &sse
+	}
+
+	results.RedirectsFollowed = int(r.redirectCount.Load())
+	for code, count := range r.statusCodes {
+		if code >= 300 && code <= 399 {
+			results.RedirectResponses += count
+		}
+	}
+
+	// The share of the 304s among the responses that could have been one,
+	// which for conditional requests is the cache hit rate
+	results.NotModified = r.statusCodes[http.StatusNotModified]
+	if results.NotModified > 0 {
+		results.NotModifiedRate = float64(results.NotModified) / float64(results.NotModified+r.statusCodes[http.StatusOK]) * 100
+	}
+
+	results.RequestRate = float64(results.Total) / totalElapsed.Seconds()
+	if results.Total > 0 {
+		results.SuccessRate = float64(results.Success) / float64(results.Total) * 100
+	}
+
+	results.Latency = summarizeLatency(r.responseTimes)
+	results.Histogram = histogram(r.responseTimes, results.Latency, r.cfg.HistBuckets)
+	results.SLO = sloBuckets(r.responseTimes, r.cfg.SLOBuckets)
+	if r.cfg.Bootstrap > 0 && len(r.responseTimes) > 1 {
+		ci := bootstrapPercentiles(sortedDurations(r.responseTimes), r.cfg.Bootstrap)
+		results.LatencyCI = &ci
+	}
+
+	if r.bodySizes.responses > 0 {
+		results.BodySize = &BodySizeResults{
+			Responses:      r.bodySizes.responses,
+			Wire:           r.bodySizes.wire,
+			Decoded:        r.bodySizes.decoded,
+			AverageWire:    float64(r.bodySizes.wire) / float64(r.bodySizes.responses),
+			AverageDecoded: float64(r.bodySizes.decoded) / float64(r.bodySizes.responses),
+		}
+	}
+
+	if r.cfg.Trace {
+		results.Phases = &PhaseResults{
+			DNS:     summarizeLatency(r.phases.dns),
+			Connect: summarizeLatency(r.phases.connect),
+			TLS:     summarizeLatency(r.phases.tls),
+			TTFB:    summarizeLatency(r.phases.ttfb),
+		}
+	}
+
+	if len(r.hostLimits) > 1 || r.cfg.PerHostRate > 0 {
+		for _, h := range r.hostLimits {
+			results.Hosts = append(results.Hosts, HostResults{
+				Host:         h.addr,
+				Requests:     int(h.requests.Load()),
+				RequestRate:  float64(h.requests.Load()) / totalElapsed.Seconds(),
+				PeakInFlight: int(h.inFlight.peak.Load()),
+			})
+		}
+	}
+
+	for i, step := range r.cfg.LoadProfile {
+		recorded := r.steps[i]
+		total := recorded.success + recorded.failure
+		results.Steps = append(results.Steps, StepResults{
+			Rate:        step.Rate,
+			Duration:    step.Duration,
+			Total:       total,
+			Failure:     recorded.failure,
+			RequestRate: float64(total) / step.Duration.Seconds(),
+			Latency:     summarizeLatency(recorded.responseTimes),
+		})
+	}
+
+	for i, body := range r.cfg.Bodies {
+		recorded := r.bodies[i]
+		results.Bodies = append(results.Bodies, BodyResults{
+			Name:    body.Name,
+			Total:   recorded.success + recorded.failure,
+			Success: recorded.success,
+			Failure: recorded.failure,
+			Latency: summarizeLatency(recorded.responseTimes),
+		})
+	}
+
+	// The breakdown only adds information when there is more than one URL
+	if len(r.targets) > 1 {
+		for i, t := range r.targets {
+			endpoint := r.endpoints[i]
+			results.Endpoints = append(results.Endpoints, EndpointResults{
+				Name:    t.Name,
+				Method:  t.Method,
+				URL:     t.URL,
+				Weight:  t.Weight,
+				Total:   endpoint.success + endpoint.failure,
+				Success: endpoint.success,
+				Failure: endpoint.failure,
+				Latency: summarizeLatency(endpoint.responseTimes),
+			})
+		}
+	}
+
+	return results
+}
+
+func summarizeLatency(durations []time.Duration) Latency {
+	latency := Latency{Samples: len(durations)}
+	if len(durations) == 0 {
+		return latency
+	}
+
+	var total time.Duration
+	for _, t := range durations {
+		total += t
+	}
+
+	sorted := sortedDurations(durations)
+	latency.Average = total / time.Duration(len(durations))
+	latency.Min = sorted[0]
+	latency.Max = sorted[len(sorted)-1]
+	latency.P50 = calculatePercentile(sorted, 50)
+	latency.P90 = calculatePercentile(sorted, 90)
+	latency.P95 = calculatePercentile(sorted, 95)
+	latency.P99 = calculatePercentile(sorted, 99)
+	latency.StdDev = standardDeviation(durations)
+	if latency.Average > 0 {
+		latency.CV = float64(latency.StdDev) / float64(latency.Average)
+	}
+
+	return latency
+}
+
+// standardDeviation returns the population standard deviation of durations,
+// computed with Welford's online algorithm so that summing squares of large
+// nanosecond values does not lose precision. A single sample has none.
+func standardDeviation(durations []time.Duration) time.Duration {
+	var mean, m2 float64
+	for i, d := range durations {
+		x := float64(d)
+		delta := x - mean
+		mean += delta / float64(i+1)
+		m2 += delta * (x - mean)
+	}
+	if len(durations) < 2 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(m2 / float64(len(durations))))
+}
+
+// histogram spreads durations over n buckets of equal width between the
+// fastest and the slowest of them
+func histogram(durations []time.Duration, latency Latency, n int) []HistogramBucket {
+	if len(durations) == 0 || n == 0 {
+		return nil
+	}
+	if latency.Min == latency.Max {
+		return []HistogramBucket{{From: latency.Min, To: latency.Max, Count: len(durations)}}
+	}
+
+	width := (latency.Max - latency.Min + time.Duration(n) - 1) / time.Duration(n)
+	buckets := make([]HistogramBucket, n)
+	for i := range buckets {
+		buckets[i].From = latency.Min + time.Duration(i)*width
+		buckets[i].To = buckets[i].From + width
+	}
+	buckets[n-1].To = latency.Max
+	for _, d := range durations {
+		i := min(int((d-latency.Min)/width), n-1)
+		buckets[i].Count++
+	}
+
+	return buckets
+}
+
+// bootstrapPercentiles estimates 95% confidence intervals of the percentiles
+// from resamples of sorted, each drawn with replacement and as large as it.
+// A resample is kept as how often every sample was drawn, so its
+// percentiles are found walking sorted instead of sorting it.
+func bootstrapPercentiles(sorted []time.Duration, resamples int) LatencyIntervals {
+	n := len(sorted)
+	percentiles := []float64{50, 90, 95, 99}
+	ranks := make([]int, len(percentiles))
+	for i, p := range percentiles {
+		ranks[i] = int(math.Ceil(p/100*float64(n))) - 1
+	}
+
+	estimates := make([][]time.Duration, len(percentiles))
+	counts := make([]int, n)
+	for resample := 0; resample < resamples; resample++ {
+		clear(counts)
+		for i := 0; i < n; i++ {
+			counts[rand.Intn(n)]++
+		}
+		drawn, next := 0, 0
+		for i, count := range counts {
+			drawn += count
+			for next < len(ranks) && drawn > ranks[next] {
+				estimates[next] = append(estimates[next], sorted[i])
+				next++
+			}
+			if next == len(ranks) {
+				break
+			}
+		}
+	}
+
+	intervals := make([]Interval, len(percentiles))
+	for i, values := range estimates {
+		slices.Sort(values)
+		intervals[i] = Interval{Low: calculatePercentile(values, 2.5), High: calculatePercentile(values, 97.5)}
+	}
+	return LatencyIntervals{P50: intervals[0], P90: intervals[1], P95: intervals[2], P99: intervals[3]}
+}
+
+// sloBuckets counts the durations up to each of the sorted bounds
+func sloBuckets(durations []time.Duration, bounds []time.Duration) []SLOBucket {
+	if len(durations) == 0 {
+		return nil
+	}
+	sorted := sortedDurations(durations)
+	buckets := make([]SLOBucket, len(bounds))
+	for i, bound := range bounds {
+		count, _ := slices.BinarySearch(sorted, bound+1)
+		buckets[i] = SLOBucket{Under: bound, Count: count, Percent: float64(count) / float64(len(sorted)) * 100}
+	}
+	return buckets
+}
+
+func printJSON(results any) {
+	if err := writeJSON(os.Stdout, results); err != nil {
+		fmt.Println("Error encoding results:", err)
 		os.Exit(1)
 	}
+}
+
+func writeJSON(out io.Writer, v any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printPrometheus writes the results in the Prometheus text exposition
+// format, e.g. for pushing to a Pushgateway after a run. Every metric carries
+// a target label with the host(s) under test. Dashboards depend on these
+// names, so they must stay stable:
+//
+//	stress_requests_total                  counter  requests sent
+//	stress_requests_success_total          counter  requests counted as success
+//	stress_requests_failed_total           counter  requests counted as failure
+//	stress_requests_retried_total          counter  requests that needed a retry
+//	stress_responses_total{code}           counter  responses per status code
+//	stress_request_duration_seconds        summary  response time quantiles, _sum and _count
+//	stress_run_duration_seconds            gauge    wall clock time of the run
+//	stress_request_rate                    gauge    average requests per second
+func printPrometheus(results Results) {
+	target := strconv.Quote(results.Target)
+
+	counter := func(name, help string, value int) {
+		fmt.Printf("# HELP %s %s\n# TYPE %s counter\n%s{target=%s} %d\n", name, help, name, name, target, value)
+	}
+	gauge := func(name, help string, value float64) {
+		fmt.Printf("# HELP %s %s\n# TYPE %s gauge\n%s{target=%s} %g\n", name, help, name, name, target, value)
+	}
+
+	counter("stress_requests_total", "Requests sent.", results.Total)
+	counter("stress_requests_success_total", "Requests counted as success.", results.Success)
+	counter("stress_requests_failed_total", "Requests counted as failure.", results.Failure)
+	counter("stress_requests_transport_errors_total", "Failed requests that got no response.", results.TransportErrors)
+	counter("stress_requests_http_errors_total", "Failed requests whose response had an unexpected status code.", results.HTTPErrors)
+	counter("stress_requests_retried_total", "Requests that needed at least one retry.", results.Retried)
+
+	fmt.Println("# HELP stress_responses_total Responses received per status code.")
+	fmt.Println("# TYPE stress_responses_total counter")
+	codes := make([]int, 0, len(results.StatusCodes))
+	for code := range results.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("stress_responses_total{target=%s,code=\"%d\"} %d\n", target, code, results.StatusCodes[code])
+	}
+
+	latency := results.Latency
+	fmt.Println("# HELP stress_request_duration_seconds Response time of the requests.")
+	fmt.Println("# TYPE stress_request_duration_seconds summary")
+	for _, q := range []struct {
+		quantile string
+		value    time.Duration
+	}{
+		{"0.5", latency.P50},
+		{"0.9", latency.P90},
+		{"0.95", latency.P95},
+		{"0.99", latency.P99},
+	} {
+		fmt.Printf("stress_request_duration_seconds{target=%s,quantile=\"%s\"} %g\n", target, q.quantile, q.value.Seconds())
+	}
+	fmt.Printf("stress_request_duration_seconds_sum{target=%s} %g\n", target, (latency.Average * time.Duration(latency.Samples)).Seconds())
+	fmt.Printf("stress_request_duration_seconds_count{target=%s} %d\n", target, latency.Samples)
+
+	gauge("stress_run_duration_seconds", "Wall clock time of the run.", results.Duration.Seconds())
+	gauge("stress_request_rate", "Average requests per second over the run.", results.RequestRate)
+}
+
+func (r *Runner) printText(results Results) {
+	if results.Success == 0 && r.cfg.noSummaryOnEmpty {
+		r.printFailureReport(results)
+		return
+	}
+
+	colors := r.summaryColors(results)
+	fmt.Printf("%sTotal: %d | Success: %d | Failure: %d | Rate: %.2f%%%s\n", colors[""], results.Total, results.Success, results.Failure, results.SuccessRate, colorEnd(colors[""]))
+	w := tabwriter.NewWriter(&colorLines{out: os.Stdout, colors: colors}, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "Metric\tValue")
+	fmt.Fprintf(w, "Target\t%s\n", strings.Join(r.targetOrigins(), ", "))
+	if len(results.Servers) > 0 {
+		fmt.Fprintf(w, "Server\t%s\n", formatCounts(results.Servers))
+	}
+	if results.Interrupted {
+		fmt.Fprintln(w, "Run\tinterrupted, partial results")
+	}
+	if results.Aborted != "" {
+		fmt.Fprintf(w, "Run\taborted after %s, partial results\n", results.Aborted)
+	}
+	fmt.Fprintf(w, "Total execution time\t%.2f sec\n", math.Round(results.Duration.Seconds()*100)/100)
+	if results.Warmup > 0 {
+		fmt.Fprintf(w, "Warmup\t%d requests, excluded\n", results.Warmup)
+	}
+	if r.cfg.PrewarmConns > 0 {
+		fmt.Fprintf(w, "Pre-warmed connections\t%d of %d\n", results.PrewarmedConns, r.cfg.PrewarmConns*len(r.hostLimits))
+	}
+	if results.RampUp > 0 {
+		fmt.Fprintf(w, "Ramp-up\t%s\n", results.RampUp)
+	}
+	fmt.Fprintf(w, "Average request rate\t%.2f requests/second\n", results.RequestRate)
+	fmt.Fprintf(w, "Peak concurrency\t%d of %d (-c)\n", results.PeakConcurrency, results.Concurrency)
+	fmt.Fprintf(w, "Requests that needed retry\t%d\n", results.Retried)
+	if results.Failure > 0 {
+		fmt.Fprintf(w, "Transport errors\t%d (no response)\n", results.TransportErrors)
+		fmt.Fprintf(w, "HTTP errors\t%d (unexpected status)\n", results.HTTPErrors)
+	}
+	if results.AbortedRequests > 0 {
+		fmt.Fprintf(w, "Aborted requests\t%d (canceled in flight, neither success nor failure)\n", results.AbortedRequests)
+	}
+	if results.ReusedConns+results.NewConns > 0 {
+		fmt.Fprintf(w, "Connection reuse\t%.2f%% (%d reused, %d new)\n", results.ReuseRatio*100, results.ReusedConns, results.NewConns)
+	}
+	if r.cfg.ExpectBodyContains != "" || r.cfg.ExpectBodyRegex != nil {
+		fmt.Fprintf(w, "Status failures\t%d\n", results.Failure-results.BodyFailures-results.HeaderFailures)
+		fmt.Fprintf(w, "Body validation failures\t%d\n", results.BodyFailures)
+	}
+	if len(r.cfg.ExpectHeaders) > 0 {
+		fmt.Fprintf(w, "Header assertion failures\t%d\n", results.HeaderFailures)
+	}
+	if results.RedirectsFollowed > 0 {
+		fmt.Fprintf(w, "Redirects followed\t%d\n", results.RedirectsFollowed)
+	}
+	if results.RedirectResponses > 0 {
+		fmt.Fprintf(w, "Redirect responses\t%d\n", results.RedirectResponses)
+	}
+	if len(results.StatusCodes) > 0 {
+		fmt.Fprintf(w, "Status codes\t%s\n", formatStatusCodes(results.StatusCodes))
+	}
+	if r.cfg.IfNoneMatch != "" || results.NotModified > 0 {
+		fmt.Fprintf(w, "Not modified (304)\t%d of %d 200 and 304 responses (%.2f%%)\n", results.NotModified,
+			results.NotModified+results.StatusCodes[http.StatusOK], results.NotModifiedRate)
+	}
+	if len(results.Protocols) > 0 {
+		fmt.Fprintf(w, "Protocols\t%s\n", formatCounts(results.Protocols))
+	}
+	if len(results.TLSVersions) > 0 {
+		fmt.Fprintf(w, "TLS versions\t%s\n", formatCounts(results.TLSVersions))
+		fmt.Fprintf(w, "TLS cipher suites\t%s\n", formatCounts(results.TLSCiphers))
+	}
+	if results.BodySize != nil {
+		fmt.Fprintf(w, "Response body size\t%s on the wire, %s decoded\n", formatBytes(float64(results.BodySize.Wire)), formatBytes(float64(results.BodySize.Decoded)))
+		fmt.Fprintf(w, "Average body size\t%s on the wire, %s decoded\n", formatBytes(results.BodySize.AverageWire), formatBytes(results.BodySize.AverageDecoded))
+	}
+	if results.Latency.Samples == 0 {
+		fmt.Fprintln(w, "Response times\tno successful responses")
+	} else {
+		fmt.Fprintf(w, "Average response time\t%s\n", formatDuration(results.Latency.Average))
+		fmt.Fprintf(w, "Min response time\t%s\n", formatDuration(results.Latency.Min))
+		fmt.Fprintf(w, "Max response time\t%s\n", formatDuration(results.Latency.Max))
+		fmt.Fprintf(w, "Standard deviation\t%s\n", formatDuration(results.Latency.StdDev))
+		fmt.Fprintf(w, "Coefficient of variation\t%.2f\n", results.Latency.CV)
+		var intervals [4]string
+		if ci := results.LatencyCI; ci != nil {
+			for i, interval := range []Interval{ci.P50, ci.P90, ci.P95, ci.P99} {
+				intervals[i] = fmt.Sprintf(" (95%% CI %s - %s)", formatDuration(interval.Low), formatDuration(interval.High))
+			}
+		}
+		fmt.Fprintf(w, "50th percentile response time\t%s%s\n", formatDuration(results.Latency.P50), intervals[0])
+		fmt.Fprintf(w, "90th percentile response time\t%s%s\n", formatDuration(results.Latency.P90), intervals[1])
+		fmt.Fprintf(w, "95th percentile response time\t%s%s\n", formatDuration(results.Latency.P95), intervals[2])
+		fmt.Fprintf(w, "99th percentile response time\t%s%s\n", formatDuration(results.Latency.P99), intervals[3])
+	}
+	w.Flush()
+
+	if len(results.Histogram) > 0 && !r.cfg.Quiet {
+		fmt.Println()
+		printHistogram(os.Stdout, results.Histogram, terminalColumns())
+	}
+
+	if len(results.SLO) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Response time\tRequests\tPercent")
+		for _, bucket := range results.SLO {
+			fmt.Fprintf(w, "<= %s\t%d\t%.2f%%\n", formatDuration(bucket.Under), bucket.Count, bucket.Percent)
+		}
+		w.Flush()
+	}
+
+	if len(results.Errors) > 0 {
+		fmt.Println()
+		printErrors(results.Errors)
+	}
+
+	if results.Phases != nil {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Phase\tSamples\tAverage\t50th percentile\t95th percentile\t99th percentile")
+		for _, phase := range []struct {
+			name    string
+			latency Latency
+		}{
+			{"DNS lookup", results.Phases.DNS},
+			{"TCP connect", results.Phases.Connect},
+			{"TLS handshake", results.Phases.TLS},
+			{"Time to first byte", results.Phases.TTFB},
+		} {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", phase.name, phase.latency.Samples,
+				formatDuration(phase.latency.Average), formatDuration(phase.latency.P50), formatDuration(phase.latency.P95), formatDuration(phase.latency.P99))
+		}
+		w.Flush()
+	}
+
+	if len(results.Throughput) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Time\tRequests\tFailures\tRequests/second\tError rate")
+		for _, window := range results.Throughput {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%.2f%%\n", window.Offset.Round(time.Millisecond), window.Requests, window.Failures, window.RequestRate, window.ErrorRate)
+		}
+		w.Flush()
+	}
+
+	if len(results.Steps) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Step\tTarget rate\tDuration\tTotal\tFailure\tRequests/second\tAverage\t99th percentile")
+		for i, step := range results.Steps {
+			fmt.Fprintf(w, "%d\t%g\t%s\t%d\t%d\t%.2f\t%s\t%s\n", i+1, step.Rate, step.Duration, step.Total, step.Failure, step.RequestRate,
+				formatDuration(step.Latency.Average), formatDuration(step.Latency.P99))
+		}
+		w.Flush()
+	}
+
+	if len(results.Hosts) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Host\tRequests\tRequests/second\tPeak in flight")
+		for _, host := range results.Hosts {
+			fmt.Fprintf(w, "%s\t%d\t%.2f\t%d\n", host.Host, host.Requests, host.RequestRate, host.PeakInFlight)
+		}
+		w.Flush()
+	}
+
+	if r.cfg.compareHosts && len(results.Endpoints) == 2 {
+		fmt.Println()
+		printHostComparison(results.Endpoints[0], results.Endpoints[1])
+	} else if len(results.Endpoints) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Endpoint\tWeight\tTotal\tSuccess\tFailure\tAverage\t99th percentile")
+		for _, endpoint := range results.Endpoints {
+			label := endpoint.Method + " " + endpoint.URL
+			if endpoint.Name != "" {
+				label = endpoint.Name + ": " + label
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", label, endpoint.Weight, endpoint.Total, endpoint.Success, endpoint.Failure,
+				formatDuration(endpoint.Latency.Average), formatDuration(endpoint.Latency.P99))
+		}
+		w.Flush()
+	}
 
-	osPrefix := ""
-	if strings.Contains(strings.ToLower(parsedUrl.Hostname()), "linux") {
-		osPrefix = "Linux"
+	if len(results.Bodies) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Body\tTotal\tSuccess\tFailure\tAverage\t99th percentile")
+		for _, body := range results.Bodies {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", body.Name, body.Total, body.Success, body.Failure,
+				formatDuration(body.Latency.Average), formatDuration(body.Latency.P99))
+		}
+		w.Flush()
+	}
+
+	if sse := results.SSE; sse != nil {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Event streams\tValue")
+		fmt.Fprintf(w, "Streams\t%d\n", sse.Streams)
+		fmt.Fprintf(w, "Events\t%d\n", sse.Events)
+		fmt.Fprintf(w, "Event rate\t%.2f events/second\n", sse.EventRate)
+		fmt.Fprintf(w, "Events per stream\tmin %d, avg %.2f, max %d\n", sse.MinEvents, sse.AverageEvents, sse.MaxEvents)
+		if sse.EventGap.Samples > 0 {
+			fmt.Fprintf(w, "Time between events\tavg %s, p50 %s, p99 %s, max %s\n", formatDuration(sse.EventGap.Average),
+				formatDuration(sse.EventGap.P50), formatDuration(sse.EventGap.P99), formatDuration(sse.EventGap.Max))
+		}
+		w.Flush()
+	}
+
+	if results.SelfStats != nil {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Load generator\tValue")
+		fmt.Fprintf(w, "Peak goroutines\t%d\n", results.SelfStats.PeakGoroutines)
+		fmt.Fprintf(w, "Peak heap\t%s\n", formatBytes(float64(results.SelfStats.PeakHeap)))
+		fmt.Fprintf(w, "Garbage collections\t%d, %s paused\n", results.SelfStats.GCCycles, formatDuration(results.SelfStats.GCPause))
+		fmt.Fprintf(w, "GOMAXPROCS\t%d\n", results.SelfStats.GOMAXPROCS)
+		w.Flush()
+	}
+
+	if r.cfg.baseline != nil {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(w, "Compared to baseline\tBaseline\tThis run\tChange\t")
+		for _, delta := range compareBaseline(*r.cfg.baseline, results, r.cfg.regressionThreshold) {
+			mark := ""
+			if delta.regressed {
+				mark = "regression"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", delta.metric, delta.baseline, delta.current, delta.change, mark)
+		}
+		w.Flush()
+	}
+}
+
+// printFailureReport stands in for the summary of a run in which no request
+// succeeded, e.g. because the server is down. Its response times would only
+// describe how fast the requests failed.
+func (r *Runner) printFailureReport(results Results) {
+	target := strings.Join(r.targetOrigins(), ", ")
+	if r.cfg.color {
+		fmt.Print(colorRed)
+		defer fmt.Print(colorReset)
+	}
+	switch {
+	case results.Total == 0:
+		fmt.Printf("No request was sent to %s\n", target)
+	case results.Failure == 0:
+		fmt.Printf("None of the %d requests sent to %s completed\n", results.Total, target)
+	default:
+		fmt.Printf("All %d requests sent to %s failed\n", results.Failure, target)
+	}
+	if results.Interrupted {
+		fmt.Println("The run was interrupted")
+	}
+	if results.Aborted != "" {
+		fmt.Printf("The run was aborted after %s\n", results.Aborted)
+	}
+	if results.Failure > 0 {
+		fmt.Printf("Transport errors: %d, HTTP errors: %d, header assertion failures: %d, body validation failures: %d\n",
+			results.TransportErrors, results.HTTPErrors, results.HeaderFailures, results.BodyFailures)
+	}
+	if results.AbortedRequests > 0 {
+		fmt.Printf("Aborted requests: %d\n", results.AbortedRequests)
+	}
+	if len(results.StatusCodes) > 0 {
+		fmt.Printf("Status codes: %s (expected %s)\n", formatStatusCodes(results.StatusCodes), r.cfg.ExpectStatus)
+	}
+	if len(results.Errors) > 0 {
+		fmt.Println()
+		printErrors(results.Errors)
+	}
+}
+
+// ANSI colors of the text summary
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorEnd resets color, if there is one
+func colorEnd(color string) string {
+	if color == "" {
+		return ""
+	}
+	return colorReset
+}
+
+// summaryColors picks the color of the rows of the summary table by their
+// label, "" being the line above the table: green without failures, red with
+// them and yellow for percentiles above -fail-if-p99-above, or a second
+// without it. Nil when the summary is not colored.
+func (r *Runner) summaryColors(results Results) map[string]string {
+	if !r.cfg.color {
+		return nil
+	}
+
+	colors := make(map[string]string)
+	if results.Failure == 0 {
+		colors[""] = colorGreen
 	} else {
-		osPrefix = "Windows"
+		colors[""] = colorRed
+		for _, label := range []string{"Transport errors", "HTTP errors", "Status failures", "Header assertion failures", "Body validation failures"} {
+			colors[label] = colorRed
+		}
 	}
+	if results.Interrupted || results.Aborted != "" {
+		colors["Run"] = colorYellow
+	}
+
+	slow := r.cfg.failIfP99Above
+	if slow == 0 {
+		slow = time.Second
+	}
+	percentiles := []struct {
+		label string
+		value time.Duration
+	}{
+		{"50th percentile response time", results.Latency.P50},
+		{"90th percentile response time", results.Latency.P90},
+		{"95th percentile response time", results.Latency.P95},
+		{"99th percentile response time", results.Latency.P99},
+	}
+	for _, p := range percentiles {
+		if p.value > slow {
+			colors[p.label] = colorYellow
+		}
+	}
+	return colors
+}
+
+// colorLines colors the lines written to it whose first cell, as tabwriter
+// renders it, is one of the labels of colors. The color wraps the whole
+// line, so the invisible escape codes do not throw off the alignment.
+type colorLines struct {
+	out     io.Writer
+	colors  map[string]string
+	pending []byte
+}
+
+func (c *colorLines) Write(p []byte) (int, error) {
+	c.pending = append(c.pending, p...)
+	for {
+		end := bytes.IndexByte(c.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		line := string(c.pending[:end])
+		c.pending = c.pending[end+1:]
+
+		label, _, _ := strings.Cut(line, "|")
+		if color, ok := c.colors[strings.TrimSpace(label)]; ok && label != line {
+			line = color + line + colorReset
+		}
+		if _, err := io.WriteString(c.out, line+"\n"); err != nil {
+			return 0, err
+		}
+	}
+}
 
-	fmt.Printf("Total: %d | Success: %d | Failure: %d | Rate: %.2f%%\n", totalRequests, successCount, failureCount, successRate)
+// printErrors lists the error categories, the most frequent first
+func printErrors(errors map[string]int) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
-	fmt.Fprintln(w, "Metric\tValue")
-	fmt.Fprintf(w, "%s\t%s\n", osPrefix, parsedUrl.Hostname())
-	fmt.Fprintf(w, "Total execution time\t%.2f sec\n", math.Round(totalElapsed.Seconds()*100)/100)
-	fmt.Fprintf(w, "Average response time\t%.2f sec\n", math.Round(averageResponseTime.Seconds()*100)/100)
-	fmt.Fprintf(w, "Average request rate\t%.2f requests/second\n", averageRequestRate)
-	fmt.Fprintf(w, "99th percentile response time\t%.2f sec\n", math.Round(percentile99.Seconds()*100)/100)
+	fmt.Fprintln(w, "Error\tAttempts")
+	categories := make([]string, 0, len(errors))
+	for category := range errors {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return errors[categories[i]] > errors[categories[j]]
+	})
+	for _, category := range categories {
+		fmt.Fprintf(w, "%s\t%d\n", category, errors[category])
+	}
+	w.Flush()
+}
+
+// printHostComparison puts the results of the two URLs of -compare-hosts
+// side by side, with how much slower or faster b was than a
+func printHostComparison(a, b EndpointResults) {
+	successRate := func(e EndpointResults) float64 {
+		if e.Total == 0 {
+			return 0
+		}
+		return float64(e.Success) / float64(e.Total) * 100
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintf(w, "Metric\tA: %s\tB: %s\tB compared to A\n", a.URL, b.URL)
+	fmt.Fprintf(w, "Requests\t%d\t%d\t\n", a.Total, b.Total)
+	fmt.Fprintf(w, "Success rate\t%.2f%%\t%.2f%%\t%+.2f points\n", successRate(a), successRate(b), successRate(b)-successRate(a))
+	rows := []struct {
+		metric string
+		a, b   time.Duration
+	}{
+		{"Average response time", a.Latency.Average, b.Latency.Average},
+		{"50th percentile", a.Latency.P50, b.Latency.P50},
+		{"90th percentile", a.Latency.P90, b.Latency.P90},
+		{"95th percentile", a.Latency.P95, b.Latency.P95},
+		{"99th percentile", a.Latency.P99, b.Latency.P99},
+	}
+	for _, row := range rows {
+		change := ""
+		if row.a > 0 {
+			percent := float64(row.b-row.a) / float64(row.a) * 100
+			switch {
+			case row.b < row.a:
+				change = fmt.Sprintf("%+.1f%%, B faster", percent)
+			case row.b > row.a:
+				change = fmt.Sprintf("%+.1f%%, A faster", percent)
+			default:
+				change = "same"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.metric, formatDuration(row.a), formatDuration(row.b), change)
+	}
+	w.Flush()
+}
+
+// terminalColumns is the terminal width in $COLUMNS, 80 without it
+func terminalColumns() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+// printHistogram draws a bar per bucket, the longest one filling what
+// columns leaves next to the labels
+func printHistogram(out io.Writer, buckets []HistogramBucket, columns int) {
+	labels := make([]string, len(buckets))
+	labelWidth, peak := 0, 0
+	for i, bucket := range buckets {
+		labels[i] = formatDuration(bucket.From) + " - " + formatDuration(bucket.To)
+		labelWidth = max(labelWidth, utf8.RuneCountInString(labels[i]))
+		peak = max(peak, bucket.Count)
+	}
+
+	// Every column is padded by two and followed by a "|"
+	countWidth := max(len("Count"), len(strconv.Itoa(peak)))
+	barWidth := max(columns-labelWidth-countWidth-6, 10)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "Response time\tCount\t")
+	for i, bucket := range buckets {
+		bar := strings.Repeat("#", int(math.Round(float64(bucket.Count)/float64(peak)*float64(barWidth))))
+		fmt.Fprintf(w, "%s\t%d\t%s\n", labels[i], bucket.Count, bar)
+	}
 	w.Flush()
 }
+
+// formatDuration renders a response time in the unit that suits its
+// magnitude: "850 µs", "15.23 ms" or "1.25 sec"
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return fmt.Sprintf("%d µs", d.Microseconds())
+	case d < time.Second:
+		return fmt.Sprintf("%.2f ms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%.2f sec", d.Seconds())
+	}
+}
+
+// formatBytes renders a byte count as "512 B", "1.5 KB" or "3.2 MB"
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	unit := 0
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
+
+// formatStatusCodes renders the status code histogram as "200: 1200, 404: 30"
+func formatStatusCodes(statusCodes map[int]int) string {
+	codes := make([]int, 0, len(statusCodes))
+	for code := range statusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%d: %d", code, statusCodes[code]))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// targetOrigins lists the distinct scheme://host of the targets in the
+// order they were given
+func (r *Runner) targetOrigins() []string {
+	var origins []string
+	for _, t := range r.targets {
+		u, _ := url.Parse(t.URL)
+		origin := u.Scheme + "://" + u.Host
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// formatCounts renders a histogram keyed by name as "HTTP/1.1: 10, HTTP/2.0: 5"
+func formatCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", key, counts[key]))
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,1183 @@
+package stress
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConfig returns the defaults of the command line aimed at urls, without
+// a rate limit so that the tests do not wait on it
+func testConfig(urls ...string) Config {
+	cfg := DefaultConfig()
+	for _, u := range urls {
+		cfg.Targets = append(cfg.Targets, Target{URL: u})
+	}
+	cfg.RequestRate = 0
+	cfg.TotalRequests = 5
+	cfg.Concurrency = 2
+	cfg.Quiet = true
+	return cfg
+}
+
+// runConfig runs cfg once and fails the test if it could not be run
+func runConfig(t *testing.T, cfg Config) Results {
+	t.Helper()
+	results, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return results
+}
+
+// countingServer answers every request with status and counts them
+func countingServer(t *testing.T, status int) (*httptest.Server, *atomic.Int64) {
+	var count atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func TestRunnerSendsEveryRequest(t *testing.T) {
+	server, count := countingServer(t, http.StatusOK)
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = 12
+	cfg.Concurrency = 3
+	results := runConfig(t, cfg)
+
+	if results.Total != 12 || results.Success != 12 || results.Failure != 0 {
+		t.Errorf("got total %d, success %d, failure %d, want 12, 12, 0", results.Total, results.Success, results.Failure)
+	}
+	if n := count.Load(); n != 12 {
+		t.Errorf("server got %d requests, want 12", n)
+	}
+	if results.StatusCodes[http.StatusOK] != 12 {
+		t.Errorf("got status codes %v, want 12 times 200", results.StatusCodes)
+	}
+}
+
+func TestRunnerRunResetsBetweenRuns(t *testing.T) {
+	server, _ := countingServer(t, http.StatusOK)
+
+	cfg := testConfig(server.URL)
+	runner, err := NewRunner(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if results := runner.Run(context.Background()); results.Total != cfg.TotalRequests || results.Latency.Samples != cfg.TotalRequests {
+			t.Errorf("run %d: got total %d and %d samples, want %d of each", i+1, results.Total, results.Latency.Samples, cfg.TotalRequests)
+		}
+	}
+}
+
+func TestRunnersAreIndependent(t *testing.T) {
+	ok, okCount := countingServer(t, http.StatusOK)
+	failing, failingCount := countingServer(t, http.StatusInternalServerError)
+
+	okCfg := testConfig(ok.URL)
+	failingCfg := testConfig(failing.URL)
+	failingCfg.TotalRequests = 7
+
+	done := make(chan Results)
+	go func() {
+		results, err := Run(context.Background(), failingCfg)
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+		done <- results
+	}()
+	okResults := runConfig(t, okCfg)
+	failingResults := <-done
+
+	if okResults.Success != 5 || okResults.Failure != 0 {
+		t.Errorf("healthy server: got success %d, failure %d, want 5, 0", okResults.Success, okResults.Failure)
+	}
+	if failingResults.Success != 0 || failingResults.HTTPErrors != 7 {
+		t.Errorf("failing server: got success %d, HTTP errors %d, want 0, 7", failingResults.Success, failingResults.HTTPErrors)
+	}
+	if okCount.Load() != 5 || failingCount.Load() != 7 {
+		t.Errorf("servers got %d and %d requests, want 5 and 7", okCount.Load(), failingCount.Load())
+	}
+}
+
+func TestMaxErrorsStopsEveryRun(t *testing.T) {
+	server, _ := countingServer(t, http.StatusInternalServerError)
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = 1000
+	cfg.Concurrency = 1
+	cfg.MaxRetries = 0
+	cfg.MaxErrors = 3
+	runner, err := NewRunner(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second run only stops if the first one left no abort reason behind
+	for i := 0; i < 2; i++ {
+		results := runner.Run(context.Background())
+		if results.Total != 3 || results.Aborted == "" {
+			t.Errorf("run %d: got total %d and abort reason %q, want 3 and a reason", i+1, results.Total, results.Aborted)
+		}
+	}
+}
+
+func TestFetchClassifiesResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/500":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/hang":
+			<-r.Context().Done()
+		case "/body":
+			fmt.Fprint(w, "hello world")
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name         string
+		path         string
+		bodyContains string
+		check        func(Results) bool
+	}{
+		{"200", "/", "", func(r Results) bool { return r.Success == 1 }},
+		{"500", "/500", "", func(r Results) bool { return r.HTTPErrors == 1 && r.StatusCodes[500] == 1 }},
+		{"timeout", "/hang", "", func(r Results) bool { return r.TransportErrors == 1 && r.Errors["timeout"] == 1 }},
+		{"body matches", "/body", "world", func(r Results) bool { return r.Success == 1 }},
+		{"body does not match", "/body", "nowhere", func(r Results) bool { return r.BodyFailures == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(server.URL + tt.path)
+			cfg.TotalRequests = 1
+			cfg.Timeout = 100 * time.Millisecond
+			cfg.MaxRetries = 0
+			cfg.ExpectBodyContains = tt.bodyContains
+			results := runConfig(t, cfg)
+
+			if results.Total != 1 || results.Success+results.Failure != 1 || !tt.check(results) {
+				t.Errorf("got %+v", results)
+			}
+		})
+	}
+}
+
+func TestFetchFailsRequestsThatCannotBeBuilt(t *testing.T) {
+	server, count := countingServer(t, http.StatusOK)
+
+	cfg := testConfig(server.URL)
+	cfg.Method = "NOT A METHOD"
+	results := runConfig(t, cfg)
+
+	if results.Total != 5 || results.Failure != 5 || results.TransportErrors != 5 {
+		t.Errorf("got total %d, failure %d, transport errors %d, want 5 of each", results.Total, results.Failure, results.TransportErrors)
+	}
+	if results.Latency.Samples != 0 || count.Load() != 0 {
+		t.Errorf("got %d response times and %d requests on the server, want none", results.Latency.Samples, count.Load())
+	}
+	if len(results.Errors) != 1 {
+		t.Errorf("got errors %v, want the invalid method", results.Errors)
+	}
+}
+
+func TestFetchRecordsLatency(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+	}))
+	t.Cleanup(server.Close)
+
+	results := runConfig(t, testConfig(server.URL))
+
+	if results.Latency.Samples != results.Total {
+		t.Errorf("got %d samples for %d requests", results.Latency.Samples, results.Total)
+	}
+	if results.Latency.Min < delay {
+		t.Errorf("got a minimum response time of %s, want at least %s", results.Latency.Min, delay)
+	}
+	if results.Latency.Max < results.Latency.P50 || results.Latency.P50 < results.Latency.Min {
+		t.Errorf("got min %s, p50 %s, max %s out of order", results.Latency.Min, results.Latency.P50, results.Latency.Max)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	server, count := countingServer(t, http.StatusServiceUnavailable)
+
+	tests := []struct {
+		name       string
+		retryOn5xx bool
+		maxRetries int
+		want       int64
+	}{
+		{"5xx not retried by default", false, 2, 1},
+		{"5xx retried with -retry-on-5xx", true, 2, 3},
+		{"no retries", true, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count.Store(0)
+			cfg := testConfig(server.URL)
+			cfg.TotalRequests = 1
+			cfg.RetryOn5xx = tt.retryOn5xx
+			cfg.MaxRetries = tt.maxRetries
+			results := runConfig(t, cfg)
+
+			if n := count.Load(); n != tt.want {
+				t.Errorf("server got %d attempts, want %d", n, tt.want)
+			}
+			if wantRetried := tt.want > 1; (results.Retried == 1) != wantRetried {
+				t.Errorf("got %d retried requests", results.Retried)
+			}
+			if results.HTTPErrors != 1 {
+				t.Errorf("got %d HTTP errors, want 1", results.HTTPErrors)
+			}
+		})
+	}
+}
+
+func TestFetchSendsHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = 1
+	cfg.Headers["X-Test"] = "yes"
+	cfg.BearerToken = "secret"
+	cfg.UserAgents = []string{"stress-test/1.0"}
+	runConfig(t, cfg)
+
+	header := <-received
+	for name, want := range map[string]string{
+		"X-Test":          "yes",
+		"Authorization":   "Bearer secret",
+		"User-Agent":      "stress-test/1.0",
+		"Accept-Encoding": "gzip, deflate",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUserAgentRotation(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Header.Get("User-Agent")]++
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	const k = 100
+	agents := []string{"agent-a/1.0", "agent-b/2.0", "agent-c/3.0", "agent-d/4.0"}
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = k * len(agents)
+	cfg.Concurrency = 4
+	cfg.UserAgents = agents
+	runConfig(t, cfg)
+
+	if len(seen) != len(agents) {
+		t.Fatalf("got user agents %v, want only %v", seen, agents)
+	}
+	// Each count is binomial with a standard deviation of about 8.7, so
+	// this is more than 5 of them either way
+	for _, agent := range agents {
+		if n := seen[agent]; n < k-45 || n > k+45 {
+			t.Errorf("got %s %d times in %d requests, want about %d", agent, n, cfg.TotalRequests, k)
+		}
+	}
+}
+
+func TestRateLimiterBoundsThroughput(t *testing.T) {
+	server, count := countingServer(t, http.StatusOK)
+
+	cfg := testConfig(server.URL)
+	cfg.RequestRate = 20
+	cfg.Duration = time.Second
+	cfg.Concurrency = 10
+	results := runConfig(t, cfg)
+
+	// 20 in the second, the one the bucket starts with and one of slack for
+	// the timing of the end of the run
+	if n := count.Load(); n > 22 || n < 10 {
+		t.Errorf("server got %d requests in 1s at -rate 20", n)
+	}
+	if results.RequestRate > 22 {
+		t.Errorf("got a request rate of %.2f/s, want at most 22", results.RequestRate)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// A body too large for the transport to drain by itself when it is
+	// closed unread, so that only reading it to the end frees the connection
+	body := strings.Repeat("x", 4<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	const n = 10
+	tests := []struct {
+		name             string
+		readBody         bool
+		disableKeepAlive bool
+		wantReused       int
+		wantNew          int
+	}{
+		{"bodies read", true, false, n - 1, 1},
+		{"-read-body=false", false, false, 0, n},
+		{"-disable-keepalive", true, true, 0, n},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(server.URL)
+			cfg.TotalRequests = n
+			cfg.Concurrency = 1
+			cfg.ReadBody = tt.readBody
+			cfg.DisableKeepAlive = tt.disableKeepAlive
+			results := runConfig(t, cfg)
+
+			if results.ReusedConns != tt.wantReused || results.NewConns != tt.wantNew {
+				t.Errorf("got %d reused and %d new connections, want %d and %d", results.ReusedConns, results.NewConns, tt.wantReused, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestPerHostRateDoesNotHoldUpOtherHosts(t *testing.T) {
+	busy, busyCount := countingServer(t, http.StatusOK)
+	quiet, quietCount := countingServer(t, http.StatusOK)
+
+	// A single worker that mostly picks the busy host, it has to send to the
+	// quiet one while the busy one is at its rate to get past 6 requests
+	cfg := testConfig()
+	cfg.Targets = []Target{{URL: busy.URL, Weight: 9}, {URL: quiet.URL, Weight: 1}}
+	cfg.PerHostRate = 5
+	cfg.Duration = time.Second
+	cfg.Concurrency = 1
+	runConfig(t, cfg)
+
+	// 5 in the second, the one the bucket starts with and one of slack
+	if n := busyCount.Load(); n > 7 {
+		t.Errorf("busy host got %d requests in 1s at -per-host-rate 5", n)
+	}
+	if n := quietCount.Load(); n < 4 || n > 7 {
+		t.Errorf("quiet host got %d requests in 1s at -per-host-rate 5, want 4 to 7", n)
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+func response(status int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestShouldRetry(t *testing.T) {
+	policies, _ := parseRetryPolicies("429:3:exponential,503:1:fixed,500:0")
+	refused := &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		name       string
+		retryOn5xx bool
+		resp       *http.Response
+		err        error
+		retries    int
+		want       bool
+	}{
+		{"timeout", false, nil, timeoutError{}, 0, true},
+		{"timeout after -retries", false, nil, timeoutError{}, 2, false},
+		{"refused", false, nil, refused, 1, true},
+		{"reset", false, nil, reset, 0, true},
+		{"other error", false, nil, errors.New("boom"), 0, false},
+		{"200", true, response(200, ""), nil, 0, false},
+		{"502 without -retry-on-5xx", false, response(502, ""), nil, 0, false},
+		{"502 with -retry-on-5xx", true, response(502, ""), nil, 1, true},
+		{"502 after -retries", true, response(502, ""), nil, 2, false},
+		{"429 under its policy", false, response(429, ""), nil, 2, true},
+		{"429 beyond -retries under its policy", false, response(429, ""), nil, 2, true},
+		{"429 after its policy", false, response(429, ""), nil, 3, false},
+		{"503 after its policy", true, response(503, ""), nil, 1, false},
+		{"500 never retried by its policy", true, response(500, ""), nil, 0, false},
+		{"404 without a policy", true, response(404, ""), nil, 0, false},
+	}
+	for _, tt := range tests {
+		r := &Runner{cfg: &Config{MaxRetries: 2, RetryOn5xx: tt.retryOn5xx, RetryPolicies: policies}}
+		if got := r.shouldRetry(tt.resp, tt.err, tt.retries); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterTimeoutResendsBody(t *testing.T) {
+	const payload = `{"name": "retried"}`
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		first := len(bodies) == 1
+		mu.Unlock()
+		// Only the first attempt times out
+		if first {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = 1
+	cfg.Method = http.MethodPost
+	cfg.Body = []byte(payload)
+	cfg.Timeout = 100 * time.Millisecond
+	cfg.MaxRetries = 1
+	results := runConfig(t, cfg)
+
+	if results.Success != 1 || results.Retried != 1 {
+		t.Errorf("got success %d, retried %d, want 1, 1", results.Success, results.Retried)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 || bodies[0] != payload || bodies[1] != payload {
+		t.Errorf("server got bodies %q, want %q twice", bodies, payload)
+	}
+}
+
+func TestBodyReadTimeoutFailsSlowBodies(t *testing.T) {
+	// Writes a byte every 20ms, for as long as the query asks
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes, _ := strconv.Atoi(r.URL.Query().Get("writes"))
+		for i := 0; i < writes; i++ {
+			w.Write([]byte("."))
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name   string
+		writes int
+		failed bool
+	}{
+		{"within the timeout", 3, false},
+		{"stalls past the timeout", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(fmt.Sprintf("%s/?writes=%d", server.URL, tt.writes))
+			cfg.TotalRequests = 1
+			cfg.MaxRetries = 0
+			cfg.BodyReadTimeout = 300 * time.Millisecond
+			start := time.Now()
+			results := runConfig(t, cfg)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("the run took %s, the body should have been cut off after %s", elapsed, cfg.BodyReadTimeout)
+			}
+			if tt.failed && (results.TransportErrors != 1 || results.Errors["reading body: timeout"] != 1) {
+				t.Errorf("got transport errors %d and errors %v, want a body read timeout", results.TransportErrors, results.Errors)
+			}
+			if !tt.failed && results.Success != 1 {
+				t.Errorf("got success %d and errors %v, want 1 success", results.Success, results.Errors)
+			}
+		})
+	}
+}
+
+func TestMethodsWithAndWithoutBody(t *testing.T) {
+	type request struct {
+		method        string
+		body          string
+		contentLength string
+	}
+	received := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Method, string(body), r.Header.Get("Content-Length")}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		method string
+		body   string
+		want   request
+	}{
+		{http.MethodGet, "", request{http.MethodGet, "", ""}},
+		{http.MethodGet, "abc", request{http.MethodGet, "", ""}},
+		{http.MethodHead, "", request{http.MethodHead, "", ""}},
+		{http.MethodHead, "abc", request{http.MethodHead, "", ""}},
+		{http.MethodDelete, "", request{http.MethodDelete, "", ""}},
+		{http.MethodDelete, "abc", request{http.MethodDelete, "abc", "3"}},
+		{http.MethodOptions, "", request{http.MethodOptions, "", ""}},
+		{http.MethodOptions, "abc", request{http.MethodOptions, "abc", "3"}},
+		// These tell the server there is no body, rather than leave it waiting
+		{http.MethodPost, "", request{http.MethodPost, "", "0"}},
+		{http.MethodPost, "abc", request{http.MethodPost, "abc", "3"}},
+		{http.MethodPut, "", request{http.MethodPut, "", "0"}},
+		{http.MethodPut, "abc", request{http.MethodPut, "abc", "3"}},
+		{http.MethodPatch, "", request{http.MethodPatch, "", "0"}},
+		{http.MethodPatch, "abc", request{http.MethodPatch, "abc", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s body %q", tt.method, tt.body), func(t *testing.T) {
+			cfg := testConfig(server.URL)
+			cfg.TotalRequests = 1
+			cfg.Method = tt.method
+			if tt.body != "" {
+				cfg.Body = []byte(tt.body)
+			}
+			results := runConfig(t, cfg)
+
+			if results.Success != 1 {
+				t.Fatalf("got success %d and errors %v, want 1 success", results.Success, results.Errors)
+			}
+			if got := <-received; got != tt.want {
+				t.Errorf("server got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	values := templateValues{seq: 42, time: time.UnixMilli(1700000000123)}
+
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second, _ := strings.Cut(expandPlaceholders("{{uuid}} {{ uuid }}", values), " ")
+	if !uuidPattern.MatchString(first) || !uuidPattern.MatchString(second) {
+		t.Errorf("got %q and %q, want version 4 UUIDs", first, second)
+	}
+	if first == second {
+		t.Errorf("got the same UUID %q twice, want one per placeholder", first)
+	}
+
+	for i := 0; i < 100; i++ {
+		n, err := strconv.Atoi(expandPlaceholders("{{randint:-3:3}}", values))
+		if err != nil || n < -3 || n > 3 {
+			t.Fatalf("got %d (%v), want an integer from -3 to 3", n, err)
+		}
+	}
+	if got := expandPlaceholders("{{randint:7:7}}", values); got != "7" {
+		t.Errorf("got %q for a range of one, want 7", got)
+	}
+	// Wider than rand.Int63n can draw from in one go
+	for _, spec := range []string{"randint:0:9223372036854775807", "randint:-9223372036854775808:9223372036854775807"} {
+		if _, err := strconv.ParseInt(expandPlaceholders("{{"+spec+"}}", values), 10, 64); err != nil {
+			t.Errorf("{{%s}}: %v", spec, err)
+		}
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/items/{{seq}}", "/items/42"},
+		{"t={{timestamp}}", "t=1700000000123"},
+		{"{{randint:5:1}}", "{{randint:5:1}}"},
+		{"{{randint:a:b}}", "{{randint:a:b}}"},
+		{"{{unknown}}", "{{unknown}}"},
+		{"no placeholders", "no placeholders"},
+	}
+	for _, tt := range tests {
+		if got := expandPlaceholders(tt.text, values); got != tt.want {
+			t.Errorf("expandPlaceholders(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestExpandPlaceholdersPrefersDataColumns(t *testing.T) {
+	values := templateValues{seq: 1, row: dataRow{columns: map[string]int{"seq": 0, "user": 1}, values: []string{"from-file", "alice"}}}
+
+	if got := expandPlaceholders("{{user}} {{seq}}", values); got != "alice from-file" {
+		t.Errorf("got %q, want the data columns to win over the built-ins", got)
+	}
+}
+
+func TestSeqIsUniqueAcrossWorkers(t *testing.T) {
+	r := &Runner{cfg: &Config{}}
+
+	const workers, perWorker = 8, 100
+	seen := make(chan int64, workers*perWorker)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				seen <- r.newTemplateValues().seq
+			}
+		}()
+	}
+	wg.Wait()
+	close(seen)
+
+	unique := make(map[int64]bool)
+	for seq := range seen {
+		if seq < 1 || seq > workers*perWorker || unique[seq] {
+			t.Fatalf("got seq %d out of range or twice", seq)
+		}
+		unique[seq] = true
+	}
+}
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{[]string{"example.com:443:10.0.0.5"}, map[string]string{"example.com:443": "10.0.0.5:443"}, false},
+		{[]string{"Example.COM:80:10.0.0.5", "api.example.com:8443:10.0.0.6"}, map[string]string{"example.com:80": "10.0.0.5:80", "api.example.com:8443": "10.0.0.6:8443"}, false},
+		{[]string{"example.com:443:[2001:db8::1]"}, map[string]string{"example.com:443": "[2001:db8::1]:443"}, false},
+		{[]string{"example.com:443"}, nil, true},
+		{[]string{"example.com:http:10.0.0.5"}, nil, true},
+		{[]string{"example.com:70000:10.0.0.5"}, nil, true},
+		{[]string{"example.com:443:backend"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseResolve(tt.values)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseResolve(%q): got error %v, want error %v", tt.values, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("parseResolve(%q) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestResolveKeepsHostAndServerName(t *testing.T) {
+	type request struct{ host, serverName string }
+	received := make(chan request, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- request{r.Host, r.TLS.ServerName}
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// The certificate of httptest is valid for example.com, which then only
+	// has to lead to the server
+	cfg := testConfig("https://example.com:" + port + "/")
+	cfg.TotalRequests = 1
+	cfg.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	cfg.TLSConfig.RootCAs.AddCert(server.Certificate())
+	var err error
+	cfg.Resolve, err = parseResolve([]string{"example.com:" + port + ":127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := runConfig(t, cfg)
+
+	if results.Success != 1 {
+		t.Fatalf("got success %d and errors %v, want 1 success", results.Success, results.Errors)
+	}
+	if got, want := <-received, (request{"example.com:" + port, "example.com"}); got != want {
+		t.Errorf("server got %+v, want %+v", got, want)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	type request struct {
+		transferEncoding string
+		contentLength    int64
+		body             string
+	}
+	received := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{strings.Join(r.TransferEncoding, ","), r.ContentLength, string(body)}
+	}))
+	t.Cleanup(server.Close)
+
+	payload := strings.Repeat("chunk ", 1000)
+	for _, chunked := range []bool{false, true} {
+		cfg := testConfig(server.URL)
+		cfg.TotalRequests = 1
+		cfg.Method = http.MethodPost
+		cfg.Body = []byte(payload)
+		cfg.Chunked = chunked
+		results := runConfig(t, cfg)
+
+		if results.Success != 1 {
+			t.Fatalf("chunked %v: got success %d and errors %v, want 1 success", chunked, results.Success, results.Errors)
+		}
+		want := request{"", int64(len(payload)), payload}
+		if chunked {
+			want = request{"chunked", -1, payload}
+		}
+		if got := <-received; got != want {
+			t.Errorf("chunked %v: server got encoding %q, length %d and %d bytes of body, want %q, %d and %d bytes", chunked,
+				got.transferEncoding, got.contentLength, len(got.body), want.transferEncoding, want.contentLength, len(want.body))
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	// A socket path must stay short, t.TempDir can be too long for one
+	dir, err := os.MkdirTemp("", "stress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type request struct{ host, path string }
+	received := make(chan request, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- request{r.Host, r.URL.RequestURI()}
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	cfg := testConfig("http://app.local/health?full=1")
+	cfg.TotalRequests = 1
+	cfg.UnixSocket = socket
+	results := runConfig(t, cfg)
+
+	if results.Success != 1 {
+		t.Fatalf("got success %d and errors %v, want 1 success", results.Success, results.Errors)
+	}
+	if got, want := <-received, (request{"app.local", "/health?full=1"}); got != want {
+		t.Errorf("server got %+v, want %+v", got, want)
+	}
+}
+
+func TestSignHMAC(t *testing.T) {
+	// The second test case of RFC 2202 and RFC 4231
+	const key, data = "Jefe", "what do ya want for nothing?"
+	tests := []struct {
+		algo string
+		want string
+	}{
+		{"sha1", "effcdf6ae5eb2fa2d27416d5f184df9c259a7c79"},
+		{"sha256", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"sha512", "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"},
+	}
+	for _, tt := range tests {
+		if got := signHMAC(hmacHashes[tt.algo], key, []byte(data)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.algo, got, tt.want)
+		}
+	}
+
+	// What -hmac-timestamp-header signs for a request sent at 1700000000
+	if got, want := signHMAC(sha256.New, "secret", []byte(`1700000000.{"id":1}`)), "3dd1b9aef568d75f6790a84bd2e5dfa1f44409eef3cbdbd3f10b837376100c11"; got != want {
+		t.Errorf("timestamped: got %s, want %s", got, want)
+	}
+}
+
+func TestHMACSignsWhatIsSent(t *testing.T) {
+	for _, timestampHeader := range []string{"", "X-Timestamp"} {
+		t.Run("timestamp header "+timestampHeader, func(t *testing.T) {
+			var mismatches atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				message := body
+				if timestampHeader != "" {
+					message = []byte(r.Header.Get(timestampHeader) + "." + string(body))
+				}
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write(message)
+				if r.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+					mismatches.Add(1)
+				}
+			}))
+			t.Cleanup(server.Close)
+
+			// The body differs for every request, it is signed once templated
+			cfg := testConfig(server.URL)
+			cfg.Method = http.MethodPost
+			cfg.Body = []byte(`{"id": {{seq}}}`)
+			cfg.HMACSecret = "secret"
+			cfg.HMACTimestampHeader = timestampHeader
+			results := runConfig(t, cfg)
+
+			if results.Success != cfg.TotalRequests || mismatches.Load() != 0 {
+				t.Errorf("got success %d and %d signatures that did not match", results.Success, mismatches.Load())
+			}
+		})
+	}
+}
+
+// clientCertificate makes a self-signed certificate for client authentication
+func clientCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stress client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert := clientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert.Leaf)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	// The handshakes without a certificate are expected to fail
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	for _, withCert := range []bool{true, false} {
+		cfg := testConfig(server.URL)
+		cfg.TotalRequests = 1
+		cfg.MaxRetries = 0
+		cfg.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		cfg.TLSConfig.RootCAs.AddCert(server.Certificate())
+		if withCert {
+			cfg.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+		results := runConfig(t, cfg)
+
+		if withCert && results.Success != 1 {
+			t.Errorf("with a certificate: got success %d and errors %v, want 1 success", results.Success, results.Errors)
+		}
+		if !withCert && results.TransportErrors != 1 {
+			t.Errorf("without a certificate: got %d transport errors, want 1", results.TransportErrors)
+		}
+	}
+}
+
+func TestParseRetryPolicies(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[int]RetryPolicy
+		wantErr bool
+	}{
+		{"429:3:exponential,503:2:fixed", map[int]RetryPolicy{429: {MaxRetries: 3}, 503: {MaxRetries: 2, Fixed: true}}, false},
+		{"429:3, 404:0", map[int]RetryPolicy{429: {MaxRetries: 3}, 404: {MaxRetries: 0}}, false},
+		{"429", nil, true},
+		{"429:1:fixed:extra", nil, true},
+		{"700:1", nil, true},
+		{"429:-1", nil, true},
+		{"429:x", nil, true},
+		{"429:1:linear", nil, true},
+		{"429:1,429:2", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRetryPolicies(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetryPolicies(%q): got error %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("parseRetryPolicies(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policies, _ := parseRetryPolicies("429:3:exponential,503:3:fixed,502:3:fixed")
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		resp    *http.Response
+		retries int
+		want    time.Duration
+	}{
+		{"transport error", 5 * time.Second, nil, 2, 400 * time.Millisecond},
+		{"no policy", 5 * time.Second, response(500, "7"), 1, 200 * time.Millisecond},
+		{"exponential", 5 * time.Second, response(429, ""), 2, 400 * time.Millisecond},
+		{"fixed", 5 * time.Second, response(503, ""), 2, 100 * time.Millisecond},
+		{"Retry-After of a 429", 5 * time.Second, response(429, "2"), 0, 2 * time.Second},
+		{"Retry-After of a 503", 5 * time.Second, response(503, "3"), 2, 3 * time.Second},
+		{"Retry-After capped at -timeout", 5 * time.Second, response(429, "3600"), 0, 5 * time.Second},
+		{"Retry-After without -timeout", 0, response(429, "3600"), 0, time.Hour},
+		{"Retry-After in the past", 5 * time.Second, response(429, "Mon, 02 Jan 2006 15:04:05 GMT"), 0, 0},
+		{"invalid Retry-After", 5 * time.Second, response(429, "soon"), 1, 200 * time.Millisecond},
+		{"Retry-After of another status", 5 * time.Second, response(502, "9"), 0, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		r := &Runner{cfg: &Config{RetryBackoff: 100 * time.Millisecond, Timeout: tt.timeout, RetryPolicies: policies}}
+		if got := r.retryDelay(tt.resp, tt.retries); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"tomorrow", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRetryAfterWaitEndsWithTheRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = 1
+	cfg.RetryPolicies, _ = parseRetryPolicies("429:1")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, err := Run(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the run took %s, the wait for Retry-After should end with it", elapsed)
+	}
+	if results.AbortedRequests != 1 || results.Failure != 0 {
+		t.Errorf("got %d aborted and %d failed requests, want 1 aborted", results.AbortedRequests, results.Failure)
+	}
+}
+
+func TestEarlierResultsSurviveTheNextRun(t *testing.T) {
+	var count atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) > 5 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := testConfig(server.URL)
+	runner, err := NewRunner(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := runner.Run(context.Background())
+	second := runner.Run(context.Background())
+
+	if !maps.Equal(first.StatusCodes, map[int]int{200: 5}) {
+		t.Errorf("first run: got status codes %v after the second run, want 5 times 200", first.StatusCodes)
+	}
+	if !maps.Equal(second.StatusCodes, map[int]int{500: 5}) {
+		t.Errorf("second run: got status codes %v, want 5 times 500", second.StatusCodes)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantURL    string
+		wantWeight int
+		wantErr    bool
+	}{
+		{"http://example.com/items?page=2", "http://example.com/items?page=2", 1, false},
+		{"http://example.com/a=3", "http://example.com/a=3", 1, false},
+		{"http://example.com/a 3", "http://example.com/a", 3, false},
+		{"http://example.com/items?page=2  5", "http://example.com/items?page=2", 5, false},
+		{"http://example.com/a 0", "", 0, true},
+		{"http://example.com/a x", "", 0, true},
+		{"example.com", "", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTarget(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTarget(%q): got error %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got.URL != tt.wantURL || got.Weight != tt.wantWeight) {
+			t.Errorf("parseTarget(%q) = %s weight %d, want %s weight %d", tt.value, got.URL, got.Weight, tt.wantURL, tt.wantWeight)
+		}
+	}
+}
+
+func TestRunFillsInDefaults(t *testing.T) {
+	server, _ := countingServer(t, http.StatusOK)
+
+	// Set up by hand rather than from DefaultConfig, as a library user might
+	cfg := Config{
+		Targets:       []Target{{URL: server.URL}},
+		TotalRequests: 3,
+		Concurrency:   1,
+		Burst:         1,
+		HMACSecret:    "secret",
+	}
+	results := runConfig(t, cfg)
+
+	if results.Success != 3 {
+		t.Errorf("got success %d and status codes %v, want 3 successes", results.Success, results.StatusCodes)
+	}
+}
+
+func TestRunClosesItsConnections(t *testing.T) {
+	server, _ := countingServer(t, http.StatusOK)
+	cfg := testConfig(server.URL)
+	cfg.Concurrency = 5
+	runConfig(t, cfg)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		runConfig(t, cfg)
+	}
+	// The connection goroutines of the client and server end shortly after
+	// the connections are closed
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Errorf("got %d goroutines after 20 runs, %d before them", n, before)
+	}
+}
+
+func TestRunCanceledByTheCallerIsInterrupted(t *testing.T) {
+	server, count := countingServer(t, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := Run(ctx, testConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !results.Interrupted || results.Aborted != "" {
+		t.Errorf("got interrupted %v and abort reason %q, want interrupted and no reason", results.Interrupted, results.Aborted)
+	}
+	if n := count.Load(); n != 0 {
+		t.Errorf("server got %d requests after the ctx was canceled", n)
+	}
+}
+
+func TestParseFlatYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]any
+		wantErr bool
+	}{
+		{"scalars", "url: http://example.com/a?b=c\nc: 20\nd: 1m\n", map[string]any{"url": "http://example.com/a?b=c", "c": "20", "d": "1m"}, false},
+		{"comments", "# smoke test\n---\nrate: 200 # per second\n\nquiet: true\n", map[string]any{"rate": "200", "quiet": "true"}, false},
+		{"quoted", "body: \"{\\\"a\\\": 1} # not a comment\"\nuser-agent: 'it''s me' # a comment\n", map[string]any{"body": `{"a": 1} # not a comment`, "user-agent": "it's me"}, false},
+		{"lists", "H:\n  - \"Accept: application/json\"\n  - 'X-Env: staging'\nurl:\n- http://a/\n- http://b/ 3\n", map[string]any{"H": []any{"Accept: application/json", "X-Env: staging"}, "url": []any{"http://a/", "http://b/ 3"}}, false},
+		{"item without a name", "- http://a/\n", nil, true},
+		{"nested", "c: 20\n  n: 5\n", nil, true},
+		{"no colon", "quiet\n", nil, true},
+		{"set twice", "c: 1\nc: 2\n", nil, true},
+		{"unterminated", "body: \"abc\n", nil, true},
+		{"after the quote", "body: 'abc' def\n", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFlatYAML([]byte(tt.content))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkFetchContention sends b.N requests from 500 workers, where every
+// response would contend for the counters and the response times if a lock
+// guarded them
+func BenchmarkFetchContention(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.TotalRequests = b.N
+	cfg.Concurrency = 500
+	runner, err := NewRunner(&cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer runner.client.CloseIdleConnections()
+
+	b.ResetTimer()
+	results := runner.Run(context.Background())
+	b.StopTimer()
+
+	if results.Success != b.N || results.Latency.Samples != b.N {
+		b.Errorf("got %d successes and %d response times for %d requests", results.Success, results.Latency.Samples, b.N)
+	}
+}